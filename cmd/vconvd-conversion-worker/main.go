@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"os"
+	"time"
 	"vconvd/conversionworker"
 	"vconvd/logger"
 
@@ -24,6 +27,14 @@ func main() {
 			Value: "4150",
 			Usage: "nsqd port",
 		},
+		cli.StringSliceFlag{
+			Name:  "nsqd-address",
+			Usage: "nsqd address to publish to and consume from, repeat for more nsqd; overrides nsqd-host and nsqd-port",
+		},
+		cli.StringSliceFlag{
+			Name:  "lookupd-http-address",
+			Usage: "nsqlookupd HTTP address to discover the nsqd to consume from, repeatable",
+		},
 		cli.StringFlag{
 			Name:  "nsqd-manager-topic",
 			Value: "vconvd-manager",
@@ -34,6 +45,55 @@ func main() {
 			Value: "vconvd-conversion",
 			Usage: "nsqd topic",
 		},
+		cli.StringFlag{
+			Name:  "nsqd-control-topic",
+			Value: "vconvd-control",
+			Usage: "nsqd control topic",
+		},
+		cli.StringFlag{
+			Name:  "chunk-path",
+			Value: "/tmp",
+			Usage: "chunk temp path",
+		},
+		cli.DurationFlag{
+			Name:  "heartbeat-interval",
+			Value: time.Second * 5,
+			Usage: "interval of heartbeats sent to the manager",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-dead-letter-topic",
+			Value: "vconvd-dead-letter",
+			Usage: "nsqd topic of the messages failed all their attempts",
+		},
+		cli.IntFlag{
+			Name:  "max-attempts",
+			Value: 5,
+			Usage: "attempts of a failed chunk before it goes to the dead letter topic",
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: time.Second * 10,
+			Usage: "delay before the first retry of a failed chunk, doubled on every next one",
+		},
+		cli.DurationFlag{
+			Name:  "retry-max-delay",
+			Value: time.Minute * 5,
+			Usage: "max delay between retries of a failed chunk",
+		},
+		cli.DurationFlag{
+			Name:  "msg-timeout",
+			Value: time.Minute * 2,
+			Usage: "nsq message timeout, in-flight messages are touched to stay within it",
+		},
+		cli.IntFlag{
+			Name:  "concurrency",
+			Value: 1,
+			Usage: "chunks processed at once",
+		},
+		cli.StringFlag{
+			Name:  "metrics-address",
+			Usage: "host:port to serve the prometheus metrics at on /metrics, disabled if empty",
+		},
 		cli.StringFlag{
 			Name:  "log-file",
 			Usage: "log to given file",
@@ -67,13 +127,32 @@ func main() {
 		return nil
 	}
 	app.Action = func(c *cli.Context) error {
+		if n := c.Int("max-attempts"); n < 1 || n > math.MaxUint16 {
+			return cli.NewExitError(fmt.Sprintf("max-attempts must be between 1 and %d", math.MaxUint16), 1)
+		}
+		if c.Duration("heartbeat-interval") <= 0 {
+			return cli.NewExitError("heartbeat-interval must be positive", 1)
+		}
+
 		log.Infof("Starting conversion worker")
 
 		config := &conversionworker.Config{
-			NsqdHost:         c.String("nsqd-host"),
-			NsqdPort:         c.Int("nsqd-port"),
-			NsqdManagerTopic: c.String("nsqd-manager-topic"),
-			NsqdTopic:        c.String("nsqd-topic"),
+			NsqdHost:             c.String("nsqd-host"),
+			NsqdPort:             c.Int("nsqd-port"),
+			NsqdAddresses:        c.StringSlice("nsqd-address"),
+			LookupdHTTPAddresses: c.StringSlice("lookupd-http-address"),
+			NsqdManagerTopic:     c.String("nsqd-manager-topic"),
+			NsqdTopic:            c.String("nsqd-topic"),
+			NsqdControlTopic:     c.String("nsqd-control-topic"),
+			ChunkPath:            c.String("chunk-path"),
+			MetricsAddress:       c.String("metrics-address"),
+			HeartbeatInterval:    c.Duration("heartbeat-interval"),
+			NsqdDeadLetterTopic:  c.String("nsqd-dead-letter-topic"),
+			MaxAttempts:          uint16(c.Int("max-attempts")),
+			RetryDelay:           c.Duration("retry-delay"),
+			RetryMaxDelay:        c.Duration("retry-max-delay"),
+			MsgTimeout:           c.Duration("msg-timeout"),
+			Concurrency:          c.Int("concurrency"),
 		}
 		w := conversionworker.ConversionWorker{Config: config}
 		w.Register()
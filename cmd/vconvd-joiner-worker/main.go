@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"time"
+	"vconvd/joinerworker"
+	"vconvd/logger"
+
+	"github.com/urfave/cli"
+)
+
+var log = logger.Log
+
+func main() {
+	app := cli.NewApp()
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "nsqd-host",
+			Value: "127.0.0.1",
+			Usage: "nsqd host",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-port",
+			Value: "4150",
+			Usage: "nsqd port",
+		},
+		cli.StringSliceFlag{
+			Name:  "nsqd-address",
+			Usage: "nsqd address to publish to and consume from, repeat for more nsqd; overrides nsqd-host and nsqd-port",
+		},
+		cli.StringSliceFlag{
+			Name:  "lookupd-http-address",
+			Usage: "nsqlookupd HTTP address to discover the nsqd to consume from, repeatable",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-manager-topic",
+			Value: "vconvd-manager",
+			Usage: "nsqd topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-topic",
+			Value: "vconvd-joiner",
+			Usage: "nsqd topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-control-topic",
+			Value: "vconvd-control",
+			Usage: "nsqd control topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-dead-letter-topic",
+			Value: "vconvd-dead-letter",
+			Usage: "nsqd topic of the messages failed all their attempts",
+		},
+		cli.IntFlag{
+			Name:  "max-attempts",
+			Value: 5,
+			Usage: "attempts of a failed join before it goes to the dead letter topic",
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: time.Second * 10,
+			Usage: "delay before the first retry of a failed join, doubled on every next one",
+		},
+		cli.DurationFlag{
+			Name:  "retry-max-delay",
+			Value: time.Minute * 5,
+			Usage: "max delay between retries of a failed join",
+		},
+		cli.DurationFlag{
+			Name:  "msg-timeout",
+			Value: time.Minute * 2,
+			Usage: "nsq message timeout, in-flight messages are touched to stay within it",
+		},
+		cli.StringFlag{
+			Name:  "chunk-path",
+			Value: "/tmp",
+			Usage: "chunk temp path",
+		},
+		cli.StringFlag{
+			Name:  "metrics-address",
+			Usage: "host:port to serve the prometheus metrics at on /metrics, disabled if empty",
+		},
+		cli.StringFlag{
+			Name:  "log-file",
+			Usage: "log to given file",
+		},
+		cli.BoolFlag{
+			Name:  "log-stderr-disable",
+			Usage: "disable log to stderr",
+		},
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "verbose logging",
+		},
+	}
+
+	app.Name = "vconvd-joiner-worker"
+	app.Version = "1.0.0"
+	app.Usage = "videoconvd joiner worker"
+	app.Before = func(c *cli.Context) error {
+		var logLevel string
+		if c.Bool("verbose") {
+			logLevel = "DEBUG"
+		} else {
+			logLevel = "INFO"
+		}
+
+		logger.SetupLogger(logger.Config{LogFile: c.String("log-file"), LogLevel: logLevel})
+		if !c.Bool("log-stderr-disable") {
+			cli.ShowVersion(c)
+		}
+
+		return nil
+	}
+	app.Action = func(c *cli.Context) error {
+		if n := c.Int("max-attempts"); n < 1 || n > math.MaxUint16 {
+			return cli.NewExitError(fmt.Sprintf("max-attempts must be between 1 and %d", math.MaxUint16), 1)
+		}
+
+		log.Infof("Starting joiner worker")
+
+		config := &joinerworker.Config{
+			NsqdHost:             c.String("nsqd-host"),
+			NsqdPort:             c.Int("nsqd-port"),
+			NsqdAddresses:        c.StringSlice("nsqd-address"),
+			LookupdHTTPAddresses: c.StringSlice("lookupd-http-address"),
+			NsqdManagerTopic:     c.String("nsqd-manager-topic"),
+			NsqdTopic:            c.String("nsqd-topic"),
+			NsqdControlTopic:     c.String("nsqd-control-topic"),
+			NsqdDeadLetterTopic:  c.String("nsqd-dead-letter-topic"),
+			ChunkPath:            c.String("chunk-path"),
+			MetricsAddress:       c.String("metrics-address"),
+			MaxAttempts:          uint16(c.Int("max-attempts")),
+			RetryDelay:           c.Duration("retry-delay"),
+			RetryMaxDelay:        c.Duration("retry-max-delay"),
+			MsgTimeout:           c.Duration("msg-timeout"),
+		}
+		w := joinerworker.JoinerWorker{Config: config}
+		w.Start()
+		return nil
+	}
+
+	app.Run(os.Args)
+}
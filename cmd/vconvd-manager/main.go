@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/urfave/cli"
 
@@ -30,6 +31,14 @@ func main() {
 			Value: "4150",
 			Usage: "nsqd port",
 		},
+		cli.StringSliceFlag{
+			Name:  "nsqd-address",
+			Usage: "nsqd address to publish to and consume from, repeat for more nsqd; overrides nsqd-host and nsqd-port",
+		},
+		cli.StringSliceFlag{
+			Name:  "lookupd-http-address",
+			Usage: "nsqlookupd HTTP address to discover the nsqd to consume from, repeatable",
+		},
 		cli.StringFlag{
 			Name:  "nsqd-manager-topic",
 			Value: "vconvd-manager",
@@ -45,6 +54,21 @@ func main() {
 			Value: "vconvd-splitter",
 			Usage: "nsqd topic",
 		},
+		cli.StringFlag{
+			Name:  "nsqd-joiner-topic",
+			Value: "vconvd-joiner",
+			Usage: "nsqd topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-control-topic",
+			Value: "vconvd-control",
+			Usage: "nsqd control topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-dead-letter-topic",
+			Value: "vconvd-dead-letter",
+			Usage: "nsqd topic of the messages failed all their attempts",
+		},
 		cli.StringFlag{
 			Name:  "rest-host",
 			Value: "127.0.0.1",
@@ -55,6 +79,61 @@ func main() {
 			Value: 8089,
 			Usage: "REST port",
 		},
+		cli.DurationFlag{
+			Name:  "chunk-duration",
+			Value: time.Minute * 2,
+			Usage: "target chunk duration",
+		},
+		cli.IntFlag{
+			Name:  "chunk-min-count",
+			Value: 1,
+			Usage: "min chunks per video",
+		},
+		cli.IntFlag{
+			Name:  "chunk-max-count",
+			Value: 100,
+			Usage: "max chunks per video",
+		},
+		cli.DurationFlag{
+			Name:  "chunk-bypass-duration",
+			Value: time.Second * 30,
+			Usage: "videos not longer than this are not split",
+		},
+		cli.IntFlag{
+			Name:  "callback-max-attempts",
+			Value: 10,
+			Usage: "HTTP callback delivery attempts",
+		},
+		cli.DurationFlag{
+			Name:  "callback-retry-delay",
+			Value: time.Second * 5,
+			Usage: "delay before the first HTTP callback retry, doubled on every next one",
+		},
+		cli.DurationFlag{
+			Name:  "callback-max-delay",
+			Value: time.Minute * 30,
+			Usage: "max delay between HTTP callback retries",
+		},
+		cli.DurationFlag{
+			Name:  "callback-timeout",
+			Value: time.Second * 10,
+			Usage: "HTTP callback request timeout",
+		},
+		cli.DurationFlag{
+			Name:  "heartbeat-interval",
+			Value: time.Second * 5,
+			Usage: "worker heartbeat interval, a worker missing a heartbeat is suspect",
+		},
+		cli.DurationFlag{
+			Name:  "heartbeat-timeout",
+			Value: time.Second * 15,
+			Usage: "worker is considered dead after no heartbeat for this long",
+		},
+		cli.IntFlag{
+			Name:  "chunk-max-attempts",
+			Value: 3,
+			Usage: "runs of a chunk lost with dead workers before the task fails",
+		},
 		cli.StringFlag{
 			Name:  "log-file",
 			Usage: "log to given file",
@@ -93,18 +172,38 @@ func main() {
 		return nil
 	}
 	app.Action = func(c *cli.Context) error {
+		if c.Duration("heartbeat-interval") <= 0 {
+			return cli.NewExitError("heartbeat-interval must be positive", 1)
+		}
+
 		log.Infof("Starting Manager")
 		setupSigHandlers()
 
 		config := &manager.Config{
-			NsqdHost:            c.String("nsqd-host"),
-			NsqdPort:            c.Int("nsqd-port"),
-			NsqdManagerTopic:    c.String("nsqd-manager-topic"),
-			NsqdConversionTopic: c.String("nsqd-conversion-topic"),
-			NsqdSplitterTopic:   c.String("nsqd-splitter-topic"),
-			RestHost:            c.String("rest-host"),
-			RestPort:            c.Int("rest-port"),
-			DbFile:              c.String("db-file"),
+			NsqdHost:                c.String("nsqd-host"),
+			NsqdPort:                c.Int("nsqd-port"),
+			NsqdAddresses:           c.StringSlice("nsqd-address"),
+			LookupdHTTPAddresses:    c.StringSlice("lookupd-http-address"),
+			NsqdManagerTopic:        c.String("nsqd-manager-topic"),
+			NsqdConversionTopic:     c.String("nsqd-conversion-topic"),
+			NsqdSplitterTopic:       c.String("nsqd-splitter-topic"),
+			NsqdJoinerTopic:         c.String("nsqd-joiner-topic"),
+			NsqdControlTopic:        c.String("nsqd-control-topic"),
+			NsqdDeadLetterTopic:     c.String("nsqd-dead-letter-topic"),
+			RestHost:                c.String("rest-host"),
+			RestPort:                c.Int("rest-port"),
+			DbFile:                  c.String("db-file"),
+			ChunkTargetDuration:     c.Duration("chunk-duration"),
+			ChunkMinCount:           c.Int("chunk-min-count"),
+			ChunkMaxCount:           c.Int("chunk-max-count"),
+			ChunkBypassDuration:     c.Duration("chunk-bypass-duration"),
+			CallbackMaxAttempts:     c.Int("callback-max-attempts"),
+			CallbackRetryDelay:      c.Duration("callback-retry-delay"),
+			CallbackMaxDelay:        c.Duration("callback-max-delay"),
+			CallbackTimeout:         c.Duration("callback-timeout"),
+			WorkerHeartbeatInterval: c.Duration("heartbeat-interval"),
+			WorkerHeartbeatTimeout:  c.Duration("heartbeat-timeout"),
+			ChunkMaxAttempts:        c.Int("chunk-max-attempts"),
 		}
 		m = &manager.Manager{Config: config}
 		m.Run()
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"vconvd/conversionworker"
+	"vconvd/joinerworker"
+	"vconvd/lib"
+	"vconvd/logger"
+	"vconvd/manager"
+	"vconvd/splitterworker"
+)
+
+var log = logger.Log
+
+var allRoles = []string{"manager", "splitter", "conversion", "joiner"}
+
+// role is the manager or a worker run in the process.
+type role struct {
+	start func()
+	stop  func()
+}
+
+func main() {
+	app := cli.NewApp()
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "roles",
+			Value: strings.Join(allRoles, ","),
+			Usage: "comma separated roles to run: " + strings.Join(allRoles, ", "),
+		},
+		cli.StringFlag{
+			Name:  "transport",
+			Value: "memory",
+			Usage: "memory to pass the messages within the process, nsq to use nsqd",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-host",
+			Value: "127.0.0.1",
+			Usage: "nsqd host",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-port",
+			Value: "4150",
+			Usage: "nsqd port",
+		},
+		cli.StringSliceFlag{
+			Name:  "nsqd-address",
+			Usage: "nsqd address to publish to and consume from, repeat for more nsqd; overrides nsqd-host and nsqd-port",
+		},
+		cli.StringSliceFlag{
+			Name:  "lookupd-http-address",
+			Usage: "nsqlookupd HTTP address to discover the nsqd to consume from, repeatable",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-manager-topic",
+			Value: "vconvd-manager",
+			Usage: "nsqd manager topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-conversion-topic",
+			Value: "vconvd-conversion",
+			Usage: "nsqd topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-splitter-topic",
+			Value: "vconvd-splitter",
+			Usage: "nsqd topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-joiner-topic",
+			Value: "vconvd-joiner",
+			Usage: "nsqd topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-control-topic",
+			Value: "vconvd-control",
+			Usage: "nsqd control topic",
+		},
+		cli.StringFlag{
+			Name:  "nsqd-dead-letter-topic",
+			Value: "vconvd-dead-letter",
+			Usage: "nsqd topic of the messages failed all their attempts",
+		},
+		cli.StringFlag{
+			Name:  "rest-host",
+			Value: "127.0.0.1",
+			Usage: "REST host",
+		},
+		cli.IntFlag{
+			Name:  "rest-port",
+			Value: 8089,
+			Usage: "REST port",
+		},
+		cli.StringFlag{
+			Name:  "db-file",
+			Value: "vconvd.bd",
+			Usage: "database file path",
+		},
+		cli.StringFlag{
+			Name:  "chunk-path",
+			Value: "/tmp",
+			Usage: "chunk temp path",
+		},
+		cli.DurationFlag{
+			Name:  "chunk-duration",
+			Value: time.Minute * 2,
+			Usage: "target chunk duration",
+		},
+		cli.IntFlag{
+			Name:  "chunk-min-count",
+			Value: 1,
+			Usage: "min chunks per video",
+		},
+		cli.IntFlag{
+			Name:  "chunk-max-count",
+			Value: 100,
+			Usage: "max chunks per video",
+		},
+		cli.DurationFlag{
+			Name:  "chunk-bypass-duration",
+			Value: time.Second * 30,
+			Usage: "videos not longer than this are not split",
+		},
+		cli.IntFlag{
+			Name:  "callback-max-attempts",
+			Value: 10,
+			Usage: "HTTP callback delivery attempts",
+		},
+		cli.DurationFlag{
+			Name:  "callback-retry-delay",
+			Value: time.Second * 5,
+			Usage: "delay before the first HTTP callback retry, doubled on every next one",
+		},
+		cli.DurationFlag{
+			Name:  "callback-max-delay",
+			Value: time.Minute * 30,
+			Usage: "max delay between HTTP callback retries",
+		},
+		cli.DurationFlag{
+			Name:  "callback-timeout",
+			Value: time.Second * 10,
+			Usage: "HTTP callback request timeout",
+		},
+		cli.DurationFlag{
+			Name:  "heartbeat-interval",
+			Value: time.Second * 5,
+			Usage: "worker heartbeat interval, a worker missing a heartbeat is suspect",
+		},
+		cli.DurationFlag{
+			Name:  "heartbeat-timeout",
+			Value: time.Second * 15,
+			Usage: "worker is considered dead after no heartbeat for this long",
+		},
+		cli.IntFlag{
+			Name:  "chunk-max-attempts",
+			Value: 3,
+			Usage: "runs of a chunk lost with dead workers before the task fails",
+		},
+		cli.IntFlag{
+			Name:  "max-attempts",
+			Value: 5,
+			Usage: "attempts of a failed chunk before it goes to the dead letter topic",
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: time.Second * 10,
+			Usage: "delay before the first retry of a failed chunk, doubled on every next one",
+		},
+		cli.DurationFlag{
+			Name:  "retry-max-delay",
+			Value: time.Minute * 5,
+			Usage: "max delay between retries of a failed chunk",
+		},
+		cli.DurationFlag{
+			Name:  "msg-timeout",
+			Value: time.Minute * 2,
+			Usage: "nsq message timeout, in-flight messages are touched to stay within it",
+		},
+		cli.IntFlag{
+			Name:  "splitter-concurrency",
+			Value: 1,
+			Usage: "chunks split at once",
+		},
+		cli.IntFlag{
+			Name:  "conversion-concurrency",
+			Value: 1,
+			Usage: "chunks converted at once",
+		},
+		cli.StringFlag{
+			Name:  "metrics-address",
+			Usage: "host:port to serve the prometheus metrics at on /metrics, disabled if empty",
+		},
+		cli.StringFlag{
+			Name:  "log-file",
+			Usage: "log to given file",
+		},
+		cli.BoolFlag{
+			Name:  "log-stderr-disable",
+			Usage: "disable log to stderr",
+		},
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "verbose logging",
+		},
+	}
+
+	app.Name = "vconvd"
+	app.Version = "1.0.0"
+	app.Usage = "videoconvd manager and workers in one process"
+	app.Before = func(c *cli.Context) error {
+		var logLevel string
+		if c.Bool("verbose") {
+			logLevel = "DEBUG"
+		} else {
+			logLevel = "INFO"
+		}
+
+		logger.SetupLogger(logger.Config{LogFile: c.String("log-file"), LogLevel: logLevel})
+		if !c.Bool("log-stderr-disable") {
+			cli.ShowVersion(c)
+		}
+
+		return nil
+	}
+	app.Action = func(c *cli.Context) error {
+		names, err := parseRoles(c.String("roles"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		if n := c.Int("max-attempts"); n < 1 || n > math.MaxUint16 {
+			return cli.NewExitError(fmt.Sprintf("max-attempts must be between 1 and %d", math.MaxUint16), 1)
+		}
+		if c.Duration("heartbeat-interval") <= 0 {
+			return cli.NewExitError("heartbeat-interval must be positive", 1)
+		}
+
+		transport, err := newTransport(c)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		if c.String("transport") == "memory" && len(names) < len(allRoles) {
+			log.Warningf("Running the roles %s only, the rest of them can not reach the in-process queue",
+				strings.Join(names, ","))
+		}
+
+		roles := make([]*role, 0, len(names))
+		for _, name := range names {
+			roles = append(roles, newRole(c, name, transport))
+		}
+
+		log.Infof("Starting %s", strings.Join(names, ", "))
+
+		var wg sync.WaitGroup
+		for _, r := range roles {
+			wg.Add(1)
+			go func(r *role) {
+				defer wg.Done()
+				r.start()
+			}(r)
+		}
+
+		// the manager serves the metrics on the REST server too
+		if addr := c.String("metrics-address"); addr != "" {
+			go func() {
+				err := lib.ServeMetrics(addr)
+				log.Errorf("Can not serve the metrics at %s: %s", addr, err)
+			}()
+		}
+
+		waitSignal()
+		for _, r := range roles {
+			r.stop()
+		}
+		wg.Wait()
+		transport.Stop()
+
+		log.Info("Gracefully stopped")
+		return nil
+	}
+
+	app.Run(os.Args)
+}
+
+func parseRoles(value string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+
+		known := false
+		for _, r := range allRoles {
+			known = known || r == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown role %q, the roles are: %s", name, strings.Join(allRoles, ", "))
+		}
+
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No roles to run")
+	}
+	return names, nil
+}
+
+func newTransport(c *cli.Context) (lib.Transport, error) {
+	switch c.String("transport") {
+	case "memory":
+		return lib.NewMemoryTransport(), nil
+	case "nsq":
+		transport := &lib.NsqTransport{
+			Host:                 c.String("nsqd-host"),
+			Port:                 c.Int("nsqd-port"),
+			Addresses:            c.StringSlice("nsqd-address"),
+			LookupdHTTPAddresses: c.StringSlice("lookupd-http-address"),
+			Log:                  true,
+		}
+		err := transport.Connect()
+		if err != nil {
+			return nil, fmt.Errorf("Can not connect producer to nsqd at %s %s", transport, err)
+		}
+		return transport, nil
+	}
+
+	return nil, fmt.Errorf("Unknown transport %q, memory or nsq is expected", c.String("transport"))
+}
+
+func newRole(c *cli.Context, name string, transport lib.Transport) *role {
+	switch name {
+	case "manager":
+		m := &manager.Manager{Transport: transport, Config: &manager.Config{
+			NsqdHost:                c.String("nsqd-host"),
+			NsqdPort:                c.Int("nsqd-port"),
+			NsqdAddresses:           c.StringSlice("nsqd-address"),
+			LookupdHTTPAddresses:    c.StringSlice("lookupd-http-address"),
+			NsqdManagerTopic:        c.String("nsqd-manager-topic"),
+			NsqdConversionTopic:     c.String("nsqd-conversion-topic"),
+			NsqdSplitterTopic:       c.String("nsqd-splitter-topic"),
+			NsqdJoinerTopic:         c.String("nsqd-joiner-topic"),
+			NsqdControlTopic:        c.String("nsqd-control-topic"),
+			NsqdDeadLetterTopic:     c.String("nsqd-dead-letter-topic"),
+			RestHost:                c.String("rest-host"),
+			RestPort:                c.Int("rest-port"),
+			DbFile:                  c.String("db-file"),
+			ChunkTargetDuration:     c.Duration("chunk-duration"),
+			ChunkMinCount:           c.Int("chunk-min-count"),
+			ChunkMaxCount:           c.Int("chunk-max-count"),
+			ChunkBypassDuration:     c.Duration("chunk-bypass-duration"),
+			CallbackMaxAttempts:     c.Int("callback-max-attempts"),
+			CallbackRetryDelay:      c.Duration("callback-retry-delay"),
+			CallbackMaxDelay:        c.Duration("callback-max-delay"),
+			CallbackTimeout:         c.Duration("callback-timeout"),
+			WorkerHeartbeatInterval: c.Duration("heartbeat-interval"),
+			WorkerHeartbeatTimeout:  c.Duration("heartbeat-timeout"),
+			ChunkMaxAttempts:        c.Int("chunk-max-attempts"),
+		}}
+		return &role{start: m.Run, stop: m.Stop}
+	case "splitter":
+		w := &splitterworker.SplitterWorker{Transport: transport, Config: &splitterworker.Config{
+			NsqdHost:             c.String("nsqd-host"),
+			NsqdPort:             c.Int("nsqd-port"),
+			NsqdAddresses:        c.StringSlice("nsqd-address"),
+			LookupdHTTPAddresses: c.StringSlice("lookupd-http-address"),
+			NsqdManagerTopic:     c.String("nsqd-manager-topic"),
+			NsqdTopic:            c.String("nsqd-splitter-topic"),
+			NsqdControlTopic:     c.String("nsqd-control-topic"),
+			NsqdDeadLetterTopic:  c.String("nsqd-dead-letter-topic"),
+			ChunkPath:            c.String("chunk-path"),
+			HeartbeatInterval:    c.Duration("heartbeat-interval"),
+			MaxAttempts:          uint16(c.Int("max-attempts")),
+			RetryDelay:           c.Duration("retry-delay"),
+			RetryMaxDelay:        c.Duration("retry-max-delay"),
+			MsgTimeout:           c.Duration("msg-timeout"),
+			Concurrency:          c.Int("splitter-concurrency"),
+		}}
+		return &role{start: w.Start, stop: w.Stop}
+	case "conversion":
+		w := &conversionworker.ConversionWorker{Transport: transport, Config: &conversionworker.Config{
+			NsqdHost:             c.String("nsqd-host"),
+			NsqdPort:             c.Int("nsqd-port"),
+			NsqdAddresses:        c.StringSlice("nsqd-address"),
+			LookupdHTTPAddresses: c.StringSlice("lookupd-http-address"),
+			NsqdManagerTopic:     c.String("nsqd-manager-topic"),
+			NsqdTopic:            c.String("nsqd-conversion-topic"),
+			NsqdControlTopic:     c.String("nsqd-control-topic"),
+			NsqdDeadLetterTopic:  c.String("nsqd-dead-letter-topic"),
+			ChunkPath:            c.String("chunk-path"),
+			HeartbeatInterval:    c.Duration("heartbeat-interval"),
+			MaxAttempts:          uint16(c.Int("max-attempts")),
+			RetryDelay:           c.Duration("retry-delay"),
+			RetryMaxDelay:        c.Duration("retry-max-delay"),
+			MsgTimeout:           c.Duration("msg-timeout"),
+			Concurrency:          c.Int("conversion-concurrency"),
+		}}
+		return &role{start: w.Register, stop: w.Stop}
+	default:
+		w := &joinerworker.JoinerWorker{Transport: transport, Config: &joinerworker.Config{
+			NsqdHost:             c.String("nsqd-host"),
+			NsqdPort:             c.Int("nsqd-port"),
+			NsqdAddresses:        c.StringSlice("nsqd-address"),
+			LookupdHTTPAddresses: c.StringSlice("lookupd-http-address"),
+			NsqdManagerTopic:     c.String("nsqd-manager-topic"),
+			NsqdTopic:            c.String("nsqd-joiner-topic"),
+			NsqdControlTopic:     c.String("nsqd-control-topic"),
+			NsqdDeadLetterTopic:  c.String("nsqd-dead-letter-topic"),
+			ChunkPath:            c.String("chunk-path"),
+			MaxAttempts:          uint16(c.Int("max-attempts")),
+			RetryDelay:           c.Duration("retry-delay"),
+			RetryMaxDelay:        c.Duration("retry-max-delay"),
+			MsgTimeout:           c.Duration("msg-timeout"),
+		}}
+		return &role{start: w.Start, stop: w.Stop}
+	}
+}
+
+func waitSignal() {
+	signalch := make(chan os.Signal, 1)
+
+	signal.Notify(
+		signalch,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGABRT,
+	)
+
+	sig := <-signalch
+	log.Warningf("Received an %s signal.", sig)
+}
@@ -1,14 +1,16 @@
 package conversionworker
 
 import (
+	"fmt"
+	"path/filepath"
+	"sync"
 	"time"
 	"vconvd/lib"
 	"vconvd/logger"
 	"vconvd/model"
 
 	"github.com/google/uuid"
-	nsq "github.com/nsqio/go-nsq"
-	"github.com/vmihailenco/msgpack"
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
 )
 
 var (
@@ -16,119 +18,466 @@ var (
 )
 
 type Config struct {
-	NsqdHost         string
-	NsqdPort         int
-	NsqdManagerTopic string
-	NsqdTopic        string
+	NsqdHost             string
+	NsqdPort             int
+	NsqdAddresses        []string
+	LookupdHTTPAddresses []string
+	NsqdManagerTopic     string
+	NsqdTopic            string
+	NsqdControlTopic     string
+	NsqdDeadLetterTopic  string
+	ChunkPath            string
+	MetricsAddress       string
+	HeartbeatInterval    time.Duration
+	MaxAttempts          uint16
+	RetryDelay           time.Duration
+	RetryMaxDelay        time.Duration
+	MsgTimeout           time.Duration
+	Concurrency          int
 }
 
 type ConversionWorker struct {
-	Config           *Config
-	producer         *lib.NsqProducer
-	consumer         *lib.NsqConsumer
-	worker           *model.Worker
-	keepAliveStarted bool
-	done             chan bool
+	Config    *Config
+	Transport lib.Transport
+
+	consumer    lib.Subscription
+	topicsLock  sync.Mutex
+	topics      map[string]lib.Subscription
+	runner      lib.FFMpegRunner
+	revocations lib.Revocations
+	retry       *lib.RetryPolicy
+	inflight    *lib.InFlight
+	// workerLock guards worker, it is updated by KeepAlive and drain
+	workerLock sync.Mutex
+	worker     *model.Worker
+	keepAlive  sync.Once
+	done       lib.Done
 }
 
 func (w *ConversionWorker) Register() {
-	w.done = make(chan bool)
-
-	w.consumer = &lib.NsqConsumer{
-		Host:  w.Config.NsqdHost,
-		Port:  w.Config.NsqdPort,
-		Topic: w.Config.NsqdTopic,
-		Log:   true,
+	w.topics = make(map[string]lib.Subscription)
+	w.retry = &lib.RetryPolicy{
+		MaxAttempts: w.Config.MaxAttempts,
+		Delay:       w.Config.RetryDelay,
+		MaxDelay:    w.Config.RetryMaxDelay,
 	}
 
-	err := w.consumer.Setup()
-	if err != nil {
-		log.Fatalf("Can not setup nsqd consumer: %s", err)
+	w.worker = &model.Worker{ID: uuid.New().String()}
+	w.updateSystemInfo()
+	worker := w.workerInfo()
+
+	if w.Transport == nil {
+		transport := &lib.NsqTransport{
+			Host:                 w.Config.NsqdHost,
+			Port:                 w.Config.NsqdPort,
+			Addresses:            w.Config.NsqdAddresses,
+			LookupdHTTPAddresses: w.Config.LookupdHTTPAddresses,
+			Log:                  true,
+		}
+		err := transport.Connect()
+		if err != nil {
+			log.Fatalf("Can not connect producer to nsqd at %s %s", transport, err)
+		} else {
+			log.Debugf("Producer succesfully connected to nsqd: %s", transport)
+		}
+		defer transport.Stop()
+
+		w.Transport = transport
 	}
 
-	w.consumer.Nsqc.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
+	config := w.subscribeConfig(w.Config.NsqdTopic)
+	w.inflight = &lib.InFlight{TouchInterval: config.TouchInterval()}
+
+	var err error
+	w.consumer, err = w.Transport.Subscribe(config, func(message *lib.Message) error {
 		w.HandleMessage(message)
 		return nil
-	}))
-
-	err = w.consumer.Connect()
+	})
 	if err != nil {
-		log.Fatalf("Can not connect consumer to nsqd at %s:%d %s", w.Config.NsqdHost, w.Config.NsqdPort, err)
-	} else {
-		log.Debugf("Consumer succesfully connected to nsqd: %s:%d", w.Config.NsqdHost, w.Config.NsqdPort)
+		log.Fatalf("Can not subscribe to the conversion topic: %s", err)
 	}
 
-	w.producer = &lib.NsqProducer{
-		Host: w.Config.NsqdHost,
-		Port: w.Config.NsqdPort,
-		Log:  true,
+	_, err = w.Transport.Subscribe(&lib.SubscribeConfig{
+		Topic:   w.Config.NsqdControlTopic,
+		Channel: lib.BroadcastChannel(),
+		Direct:  true,
+	}, func(message *lib.Message) error {
+		w.handleControlMessage(message)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Can not subscribe to the control topic: %s", err)
 	}
-	err = w.producer.Setup()
+
+	// the manager replies and sends the worker commands to its own topic
+	_, err = w.Transport.Subscribe(&lib.SubscribeConfig{
+		Topic:   model.WorkerTopic(worker.ID),
+		Channel: "control#ephemeral",
+		// the topic is new, the registration reply must not wait for
+		// the next nsqlookupd poll
+		Direct: true,
+	}, func(message *lib.Message) error {
+		w.handleControlMessage(message)
+		return nil
+	})
 	if err != nil {
-		log.Fatalf("Can not connect producer to nsqd at %s:%d %s", w.Config.NsqdHost, w.Config.NsqdPort, err)
-	} else {
-		log.Debugf("Producer succesfully connected to nsqd: %s:%d", w.Config.NsqdHost, w.Config.NsqdPort)
+		log.Fatalf("Can not subscribe to the worker topic: %s", err)
 	}
 
-	worker := model.Worker{}
-	worker.ID = string(uuid.New().String())
-	w.worker = &worker
+	log.Infof("Worker %s: %d CPUs, %d slots, ffmpeg %s with %d encoders",
+		worker.ID, worker.CPUCount, worker.Slots, worker.FFMpegVersion, len(worker.Encoders))
 
-	task := model.Task{Name: "conversion-worker:register", Data: worker}
-	data, err := msgpack.Marshal(task)
+	data, err := model.EncodeTask(w.worker.ID, "conversion-worker:register", worker)
 	if err != nil {
 		log.Errorf("Failed to marshal a worker data to the msgpack format: %s", err)
 		return
 	}
 
-	w.producer.Nsqp.Publish(w.Config.NsqdManagerTopic, data)
+	w.Transport.Publish(w.Config.NsqdManagerTopic, data)
+
+	if w.Config.MetricsAddress != "" {
+		go func() {
+			err := lib.ServeMetrics(w.Config.MetricsAddress)
+			log.Errorf("Can not serve the metrics at %s: %s", w.Config.MetricsAddress, err)
+		}()
+	}
 
-	<-w.done
+	<-w.done.C()
 }
 
 func (w *ConversionWorker) KeepAlive() {
-	if !w.keepAliveStarted {
+	w.keepAlive.Do(func() {
 		go func() {
 			for true {
-				task := model.Task{Name: "conversion-worker:ping", Data: w.worker}
-				data, err := msgpack.Marshal(task)
+				w.updateSystemInfo()
+				worker := w.workerInfo()
+				data, err := model.EncodeTask(worker.ID, "conversion-worker:ping", &worker)
 				if err != nil {
 					log.Errorf("Failed to marshal a task data to the msgpack format: %s", err)
 					return
 				}
 
-				err = w.producer.Nsqp.Publish(w.Config.NsqdManagerTopic, data)
+				err = w.Transport.Publish(w.Config.NsqdManagerTopic, data)
 				if err != nil {
 					log.Fatalf("Failed to publish the task to the queue %s:", err)
 				}
 
-				time.Sleep(time.Second * 5)
+				select {
+				case <-w.done.C():
+					return
+				case <-time.After(w.Config.HeartbeatInterval):
+				}
 			}
 		}()
+	})
+}
+
+// workerInfo returns a copy of the worker reported to the manager.
+func (w *ConversionWorker) workerInfo() model.Worker {
+	w.workerLock.Lock()
+	defer w.workerLock.Unlock()
+
+	return *w.worker
+}
+
+// updateSystemInfo refreshes the capabilities reported to the manager.
+func (w *ConversionWorker) updateSystemInfo() {
+	info := lib.GetSystemInfo(w.Config.ChunkPath)
 
-		w.keepAliveStarted = true
+	w.workerLock.Lock()
+	defer w.workerLock.Unlock()
+
+	w.worker.Hostname = info.Hostname
+	w.worker.CPUCount = info.CPUCount
+	w.worker.FreeMemory = info.FreeMemory
+	w.worker.FreeDisk = info.FreeDisk
+	w.worker.FFMpegVersion = info.FFMpegVersion
+	w.worker.Encoders = info.Encoders
+	w.worker.Decoders = info.Decoders
+	w.worker.Slots = w.concurrency()
+}
+
+func (w *ConversionWorker) subscribeConfig(topic string) *lib.SubscribeConfig {
+	return &lib.SubscribeConfig{
+		Topic:       topic,
+		MaxAttempts: w.Config.MaxAttempts,
+		MsgTimeout:  w.Config.MsgTimeout,
+		MaxInFlight: w.concurrency(),
+		Concurrency: w.concurrency(),
+		// the capability topics are announced before the chunks are
+		// published to them
+		Direct: true,
 	}
 }
 
+func (w *ConversionWorker) concurrency() int {
+	if w.Config.Concurrency < 1 {
+		return 1
+	}
+	return w.Config.Concurrency
+}
+
 func (w *ConversionWorker) Stop() {
-	w.done <- true
+	w.done.Close()
 }
 
-func (w *ConversionWorker) HandleMessage(message *nsq.Message) error {
-	var task model.Task
-	err := msgpack.Unmarshal(message.Body, &task)
+func (w *ConversionWorker) HandleMessage(message *lib.Message) error {
+	return w.handleMessage(w.Config.NsqdTopic, message)
+}
+
+func (w *ConversionWorker) handleMessage(topic string, message *lib.Message) error {
+	task, err := model.DecodeTask(message.Body)
 	if err != nil {
 		log.Errorf("Can not unmarshal a message: %s", err)
+		lib.CountMessageError("conversion", "")
+		message.Finish()
+		return err
+	}
+	task.Message = message
+
+	if !w.inflight.Begin(message) {
+		log.Debugf("Ignoring a redelivery of the message %s", message.ID)
+		return nil
+	}
+
+	switch task.Name {
+	case "conversion:convert":
+		err = w.convert(task)
+	}
+
+	if err != nil {
+		lib.CountMessageError("conversion", task.Name)
+	}
+	w.retry.Settle(w.inflight, message, err, func(latest *lib.Message) {
+		task.Message = latest
+		w.giveUp(topic, task, err)
+	})
+
+	return nil
+}
+
+// giveUp reports the conversion out of attempts to the manager. Its dead
+// letter keeps the topic, as the chunk may come from a capability topic.
+func (w *ConversionWorker) giveUp(topic string, task *model.Task, err error) {
+	letter := model.NewDeadLetter(topic, task, err)
+
+	perr := w.publish("conversion-worker:error", model.ConvertErrorTask{
+		ID:       letter.TaskID,
+		Sequence: letter.Sequence,
+		Attempt:  task.Data.(*model.ConvertTask).Attempt,
+		WorkerID: w.worker.ID,
+		Error:    err.Error(),
+	})
+	if perr != nil {
+		log.Errorf("Failed to publish a ConvertErrorTask: %s", perr)
+	}
+
+	perr = model.PublishDeadLetter(w.Transport, w.Config.NsqdDeadLetterTopic, w.worker.ID, letter)
+	if perr != nil {
+		log.Errorf("Failed to publish a dead letter of the task %s: %s", letter.TaskID, perr)
+	}
+}
+
+func (w *ConversionWorker) handleControlMessage(message *lib.Message) error {
+	task, err := model.DecodeTask(message.Body)
+	if err != nil {
+		log.Errorf("Can not unmarshal a control message: %s", err)
+		lib.CountMessageError("conversion", "")
 		message.Finish()
 		return err
 	}
 
 	switch task.Name {
+	case "conversion:cancel":
+		w.cancel(task)
+	case "conversion:revoke":
+		w.revoke(task)
+	case "conversion-worker:subscribe":
+		w.subscribe(task)
 	case "conversion-worker:registered":
 		log.Infof("Registered succesfully")
 		w.KeepAlive()
+	case "conversion-worker:drain":
+		w.drain()
 	}
 
-	message.Finish()
 	return nil
 }
+
+func (w *ConversionWorker) cancel(task *model.Task) {
+	cancelTask := task.Data.(*model.CancelTask)
+
+	log.Infof("Cancelling the task %s", cancelTask.ID)
+
+	w.runner.Cancel(cancelTask.ID)
+	err := lib.RemoveChunkFiles(w.Config.ChunkPath, cancelTask.ID)
+	if err != nil {
+		log.Errorf("Can not remove chunk files of the task %s: %s", cancelTask.ID, err)
+	}
+}
+
+// revoke stops the conversion attempts the manager has given out again.
+func (w *ConversionWorker) revoke(task *model.Task) {
+	revokeTask := task.Data.(*model.RevokeTask)
+	if revokeTask.Name != "conversion:convert" {
+		return
+	}
+
+	log.Debugf("Revoking the conversion attempt %d of the chunk %d of the task %s",
+		revokeTask.Attempt, revokeTask.Sequence, revokeTask.ID)
+	w.revocations.Revoke(revokeTask.ID, revokeTask.Sequence, revokeTask.Attempt)
+}
+
+// subscribe consumes the capability topics the worker has all the encoders
+// for. The shared channel lets the capable workers balance the chunks.
+func (w *ConversionWorker) subscribe(task *model.Task) {
+	subscribeTask := task.Data.(*model.SubscribeTask)
+
+	w.topicsLock.Lock()
+	defer w.topicsLock.Unlock()
+
+	worker := w.workerInfo()
+	if worker.Draining {
+		return
+	}
+
+	for _, topic := range subscribeTask.Topics {
+		if topic == nil || w.topics[topic.Topic] != nil || !worker.CanEncode(topic.Encoders) {
+			continue
+		}
+
+		name := topic.Topic
+		consumer, err := w.Transport.Subscribe(w.subscribeConfig(name), func(message *lib.Message) error {
+			w.handleMessage(name, message)
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Can not subscribe to the topic %s: %s", name, err)
+			continue
+		}
+
+		w.topics[topic.Topic] = consumer
+		log.Infof("Subscribed to the conversion topic %s", topic.Topic)
+	}
+}
+
+// drain stops taking new chunks. The chunks in progress are finished and
+// the worker keeps reporting to the manager until it is stopped.
+func (w *ConversionWorker) drain() {
+	w.topicsLock.Lock()
+	defer w.topicsLock.Unlock()
+
+	log.Infof("Draining, no new chunks will be taken")
+
+	w.workerLock.Lock()
+	w.worker.Draining = true
+	w.workerLock.Unlock()
+
+	w.consumer.ChangeMaxInFlight(0)
+	for _, consumer := range w.topics {
+		consumer.ChangeMaxInFlight(0)
+	}
+}
+
+func (w *ConversionWorker) convert(task *model.Task) error {
+	convertTask := task.Data.(*model.ConvertTask)
+
+	if w.runner.IsCancelled(convertTask.ID) {
+		log.Debugf("Dropping the chunk %d of the cancelled task %s", convertTask.Sequence, convertTask.ID)
+		return nil
+	}
+
+	// every run has a file of its own, so a duplicate of the run never
+	// writes a file which is being joined
+	path := filepath.FromSlash(fmt.Sprintf("%s/%s_%d_%d_%s_converted%s",
+		w.Config.ChunkPath,
+		convertTask.ID,
+		convertTask.Sequence,
+		convertTask.Attempt,
+		w.worker.ID,
+		convertTask.OutputExt,
+	))
+
+	args := ffmpeg_go.KwArgs{}
+	for k, v := range convertTask.FFMpegArgs {
+		args[k] = v
+	}
+
+	stream := ffmpeg_go.
+		Input(convertTask.ChunkFile).
+		Output(path, args).
+		OverWriteOutput().
+		ErrorToStdOut()
+
+	ctx, ok := w.revocations.Begin(stream.Context, convertTask.ID, convertTask.Sequence, convertTask.Attempt)
+	if !ok {
+		log.Debugf("Dropping the revoked conversion attempt %d of the chunk %d of the task %s",
+			convertTask.Attempt, convertTask.Sequence, convertTask.ID)
+		return nil
+	}
+	defer w.revocations.End(convertTask.ID, convertTask.Sequence, convertTask.Attempt)
+	stream.Context = ctx
+
+	err := w.publish("conversion-worker:start", model.ConvertStartedTask{
+		ID:       convertTask.ID,
+		Sequence: convertTask.Sequence,
+		Attempt:  convertTask.Attempt,
+		WorkerID: w.worker.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to publish a ConvertStartedTask: %s", err)
+	}
+
+	started := time.Now()
+	var speed float64
+	err = w.runner.RunWithProgress(convertTask.ID, stream, func(progress lib.FFMpegProgress) {
+		speed = progress.Speed
+		perr := w.publish("conversion-worker:progress", model.ChunkProgressTask{
+			ID:       convertTask.ID,
+			Sequence: convertTask.Sequence,
+			Attempt:  convertTask.Attempt,
+			WorkerID: w.worker.ID,
+			OutTime:  progress.OutTime.Seconds(),
+			Speed:    progress.Speed,
+			FPS:      progress.FPS,
+		})
+		if perr != nil {
+			log.Errorf("Failed to publish a ChunkProgressTask: %s", perr)
+		}
+	})
+
+	if err == lib.ErrCancelled {
+		log.Infof("Conversion of the chunk %d of the task %s is cancelled", convertTask.Sequence, convertTask.ID)
+		return nil
+	}
+	if w.revocations.IsRevoked(convertTask.ID, convertTask.Sequence, convertTask.Attempt) {
+		log.Infof("Conversion of the chunk %d of the task %s is revoked", convertTask.Sequence, convertTask.ID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Conversion error: %s", err)
+	}
+	lib.ObserveStage("convert", started, speed)
+
+	err = w.publish("conversion-worker:finish", model.ConvertFinishedTask{
+		ID:        convertTask.ID,
+		Sequence:  convertTask.Sequence,
+		Attempt:   convertTask.Attempt,
+		WorkerID:  w.worker.ID,
+		ChunkFile: path,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to publish a ConvertFinishedTask: %s", err)
+	}
+
+	return nil
+}
+
+func (w *ConversionWorker) publish(name string, data interface{}) error {
+	buf, err := model.EncodeTask(w.worker.ID, name, data)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal a task data to the msgpack format: %s", err)
+	}
+
+	return w.Transport.Publish(w.Config.NsqdManagerTopic, buf)
+}
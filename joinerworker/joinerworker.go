@@ -0,0 +1,274 @@
+package joinerworker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"vconvd/lib"
+	"vconvd/logger"
+	"vconvd/model"
+
+	"github.com/google/uuid"
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+var log = logger.Log
+
+type Config struct {
+	NsqdHost             string
+	NsqdPort             int
+	NsqdAddresses        []string
+	LookupdHTTPAddresses []string
+	NsqdManagerTopic     string
+	NsqdTopic            string
+	NsqdControlTopic     string
+	NsqdDeadLetterTopic  string
+	ChunkPath            string
+	MetricsAddress       string
+	MaxAttempts          uint16
+	RetryDelay           time.Duration
+	RetryMaxDelay        time.Duration
+	MsgTimeout           time.Duration
+}
+
+type JoinerWorker struct {
+	Config    *Config
+	Transport lib.Transport
+
+	id       string
+	retry    *lib.RetryPolicy
+	inflight *lib.InFlight
+	runner   lib.FFMpegRunner
+	done     lib.Done
+}
+
+func (w *JoinerWorker) Start() {
+	w.id = uuid.New().String()
+	w.retry = &lib.RetryPolicy{
+		MaxAttempts: w.Config.MaxAttempts,
+		Delay:       w.Config.RetryDelay,
+		MaxDelay:    w.Config.RetryMaxDelay,
+	}
+
+	if w.Transport == nil {
+		transport := &lib.NsqTransport{
+			Host:                 w.Config.NsqdHost,
+			Port:                 w.Config.NsqdPort,
+			Addresses:            w.Config.NsqdAddresses,
+			LookupdHTTPAddresses: w.Config.LookupdHTTPAddresses,
+			Log:                  true,
+		}
+		err := transport.Connect()
+		if err != nil {
+			log.Fatalf("Can not connect producer to nsqd at %s %s", transport, err)
+		} else {
+			log.Debugf("Producer succesfully connected to nsqd: %s", transport)
+		}
+		defer transport.Stop()
+
+		w.Transport = transport
+	}
+
+	config := &lib.SubscribeConfig{
+		Topic:       w.Config.NsqdTopic,
+		MaxAttempts: w.Config.MaxAttempts,
+		MsgTimeout:  w.Config.MsgTimeout,
+	}
+	w.inflight = &lib.InFlight{TouchInterval: config.TouchInterval()}
+
+	_, err := w.Transport.Subscribe(config, func(message *lib.Message) error {
+		w.handleMessage(message)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Can not subscribe to the joiner topic: %s", err)
+	}
+
+	_, err = w.Transport.Subscribe(&lib.SubscribeConfig{
+		Topic:   w.Config.NsqdControlTopic,
+		Channel: lib.BroadcastChannel(),
+		Direct:  true,
+	}, func(message *lib.Message) error {
+		w.handleControlMessage(message)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Can not subscribe to the control topic: %s", err)
+	}
+
+	if w.Config.MetricsAddress != "" {
+		go func() {
+			err := lib.ServeMetrics(w.Config.MetricsAddress)
+			log.Errorf("Can not serve the metrics at %s: %s", w.Config.MetricsAddress, err)
+		}()
+	}
+
+	<-w.done.C()
+}
+
+func (w *JoinerWorker) Stop() {
+	w.done.Close()
+}
+
+func (w *JoinerWorker) handleMessage(m *lib.Message) error {
+	task, err := model.DecodeTask(m.Body)
+	if err != nil {
+		log.Errorf("Can not unmarshal a message: %s", err)
+		lib.CountMessageError("joiner", "")
+		m.Finish()
+		return err
+	}
+
+	task.Message = m
+
+	log.Debugf("Got a message: %v", task)
+
+	if !w.inflight.Begin(m) {
+		log.Debugf("Ignoring a redelivery of the message %s", m.ID)
+		return nil
+	}
+
+	err = nil
+	switch task.Name {
+	case "conversion:join":
+		err = w.join(task)
+	}
+
+	if err != nil {
+		lib.CountMessageError("joiner", task.Name)
+	}
+	w.retry.Settle(w.inflight, m, err, func(latest *lib.Message) {
+		task.Message = latest
+		w.giveUp(task, err)
+	})
+
+	return nil
+}
+
+// giveUp reports the join out of attempts to the manager and dead letters it.
+func (w *JoinerWorker) giveUp(task *model.Task, err error) {
+	letter := model.NewDeadLetter(w.Config.NsqdTopic, task, err)
+
+	perr := w.publish("joiner-worker:error", model.JoinErrorTask{ID: letter.TaskID, Error: err.Error()})
+	if perr != nil {
+		log.Errorf("Failed to publish a JoinErrorTask: %s", perr)
+	}
+
+	perr = model.PublishDeadLetter(w.Transport, w.Config.NsqdDeadLetterTopic, w.id, letter)
+	if perr != nil {
+		log.Errorf("Failed to publish a dead letter of the task %s: %s", letter.TaskID, perr)
+	}
+}
+
+func (w *JoinerWorker) handleControlMessage(m *lib.Message) error {
+	task, err := model.DecodeTask(m.Body)
+	if err != nil {
+		log.Errorf("Can not unmarshal a control message: %s", err)
+		lib.CountMessageError("joiner", "")
+		m.Finish()
+		return err
+	}
+
+	switch task.Name {
+	case "conversion:cancel":
+		w.cancel(task)
+	}
+
+	return nil
+}
+
+func (w *JoinerWorker) cancel(task *model.Task) {
+	cancelTask := task.Data.(*model.CancelTask)
+
+	log.Infof("Cancelling the task %s", cancelTask.ID)
+
+	w.runner.Cancel(cancelTask.ID)
+	err := lib.RemoveChunkFiles(w.Config.ChunkPath, cancelTask.ID)
+	if err != nil {
+		log.Errorf("Can not remove chunk files of the task %s: %s", cancelTask.ID, err)
+	}
+}
+
+func (w *JoinerWorker) join(task *model.Task) error {
+	joinTask := task.Data.(*model.JoinTask)
+
+	if w.runner.IsCancelled(joinTask.ID) {
+		log.Debugf("Dropping the join of the cancelled task %s", joinTask.ID)
+		return nil
+	}
+
+	err := w.publish("joiner-worker:start", model.JoinStartedTask{ID: joinTask.ID})
+	if err != nil {
+		return fmt.Errorf("Failed to publish a JoinStartedTask: %s", err)
+	}
+
+	started := time.Now()
+	err = w.concat(joinTask)
+	if err == lib.ErrCancelled {
+		log.Infof("Joining of the task %s is cancelled", joinTask.ID)
+		// the output is left half written by the killed ffmpeg
+		os.Remove(joinTask.OutputFile)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Joining error: %s", err)
+	}
+	lib.ObserveStage("join", started, 0)
+
+	err = w.publish("joiner-worker:finish", model.JoinFinishedTask{ID: joinTask.ID, OutputFile: joinTask.OutputFile})
+	if err != nil {
+		return fmt.Errorf("Failed to publish a JoinFinishedTask: %s", err)
+	}
+
+	// the chunks are kept until the finish is published, as the join is
+	// retried if it fails
+	err = lib.RemoveChunkFiles(w.Config.ChunkPath, joinTask.ID)
+	if err != nil {
+		log.Errorf("Can not remove chunk files of the task %s: %s", joinTask.ID, err)
+	}
+
+	return nil
+}
+
+// concat stitches the chunks together with the ffmpeg concat demuxer.
+// The chunk files are expected to be in the playback order already.
+func (w *JoinerWorker) concat(joinTask *model.JoinTask) error {
+	listPath := filepath.FromSlash(fmt.Sprintf("%s/%s_concat.txt", w.Config.ChunkPath, joinTask.ID))
+
+	var list strings.Builder
+	for _, file := range joinTask.ChunkFiles {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+	}
+
+	err := os.WriteFile(listPath, []byte(list.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("Can not write the concat list: %s", err)
+	}
+	defer os.Remove(listPath)
+
+	return w.runner.Run(joinTask.ID, ffmpeg_go.
+		Input(listPath, ffmpeg_go.KwArgs{
+			"f":    "concat",
+			"safe": 0,
+		}).
+		Output(joinTask.OutputFile, ffmpeg_go.KwArgs{
+			"c": "copy",
+		}).
+		OverWriteOutput().
+		ErrorToStdOut())
+}
+
+func (w *JoinerWorker) publish(name string, data interface{}) error {
+	buf, err := model.EncodeTask(w.id, name, data)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal a task data to the msgpack format: %s", err)
+	}
+
+	return w.Transport.Publish(w.Config.NsqdManagerTopic, buf)
+}
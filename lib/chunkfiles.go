@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// RemoveChunkFiles removes the temporary files of the task from the chunk
+// path. All of them are named after the task id.
+func RemoveChunkFiles(chunkPath string, id string) error {
+	files, err := filepath.Glob(filepath.Join(chunkPath, id+"_*"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
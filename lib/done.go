@@ -0,0 +1,27 @@
+package lib
+
+import "sync"
+
+// Done is the stop signal of a long running component. The zero value is
+// ready to use, so the component may be stopped before it starts waiting.
+type Done struct {
+	once      sync.Once
+	closeOnce sync.Once
+	ch        chan struct{}
+}
+
+// C returns the channel closed by Close.
+func (d *Done) C() <-chan struct{} {
+	d.once.Do(func() {
+		d.ch = make(chan struct{})
+	})
+	return d.ch
+}
+
+// Close signals the stop, the repeated calls are ignored.
+func (d *Done) Close() {
+	d.C()
+	d.closeOnce.Do(func() {
+		close(d.ch)
+	})
+}
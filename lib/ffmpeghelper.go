@@ -1,7 +1,12 @@
 package lib
 
 import (
+	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Jeffail/gabs/v2"
 	ffmpeg_go "github.com/u2takey/ffmpeg-go"
@@ -10,12 +15,14 @@ import (
 type FFMpegHelper struct {
 	Filepath string
 	JSON     gabs.Container
+	// Timeout limits every ffprobe run, there is no limit if zero
+	Timeout time.Duration
 }
 
 func (f *FFMpegHelper) Parse(filepath string) error {
 	f.Filepath = filepath
 
-	probe, err := ffmpeg_go.Probe(filepath)
+	probe, err := ffmpeg_go.ProbeWithTimeout(filepath, f.Timeout, ffmpeg_go.KwArgs{})
 	if err != nil {
 		return err
 	}
@@ -38,3 +45,70 @@ func (f *FFMpegHelper) GetLength() (float64, error) {
 
 	return d, nil
 }
+
+// GetStartTime returns the timestamp the file starts at, non-zero e.g. for
+// MPEG-TS streams. It is zero if the container does not report it.
+func (f *FFMpegHelper) GetStartTime() float64 {
+	s, ok := f.JSON.Path("format.start_time").Data().(string)
+	if !ok {
+		return 0
+	}
+
+	t, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+
+	return t
+}
+
+// GetKeyframes returns the sorted timestamps of the video keyframes in
+// seconds within the window around each of the given times, or in the whole
+// file if there are none. They are relative to the start time of the file,
+// as the input seeking is. Only packet headers are read, so it does not
+// decode the video.
+func (f *FFMpegHelper) GetKeyframes(around []float64, window float64) ([]float64, error) {
+	start := f.GetStartTime()
+
+	args := ffmpeg_go.KwArgs{
+		"v":              "error",
+		"select_streams": "v:0",
+		"show_entries":   "packet=pts_time,flags",
+		"of":             "csv=print_section=0",
+	}
+	if len(around) > 0 {
+		// the intervals are in the timestamps of the file
+		intervals := make([]string, 0, len(around))
+		for _, t := range around {
+			from := math.Max(t-window, 0)
+			intervals = append(intervals, fmt.Sprintf("%f%%+%f", start+from, t+window-from))
+		}
+		args["read_intervals"] = strings.Join(intervals, ",")
+	}
+
+	out, err := ffmpeg_go.ProbeWithTimeoutExec(f.Filepath, f.Timeout, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyframes []float64
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 2 || !strings.Contains(fields[1], "K") {
+			continue
+		}
+
+		t, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			// packets without pts are reported as N/A
+			continue
+		}
+		if t -= start; t < 0 {
+			continue
+		}
+		keyframes = append(keyframes, t)
+	}
+
+	sort.Float64s(keyframes)
+	return keyframes, nil
+}
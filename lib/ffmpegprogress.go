@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progress messages are sent not more often than this
+const progressInterval = time.Second * 2
+
+// FFMpegProgress is a report of the ffmpeg -progress output.
+type FFMpegProgress struct {
+	OutTime time.Duration
+	FPS     float64
+	Speed   float64
+}
+
+// parseProgress reads the key=value blocks of the ffmpeg -progress output
+// and calls fn at the end of every block, but not more often than the
+// given interval. The last block is always reported.
+func parseProgress(r io.Reader, interval time.Duration, fn func(progress FFMpegProgress)) {
+	var progress FFMpegProgress
+	var last time.Time
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], strings.TrimSpace(kv[1])
+
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// out_time_ms is in microseconds too despite its name
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				progress.OutTime = time.Duration(us) * time.Microsecond
+			}
+		case "fps":
+			if fps, err := strconv.ParseFloat(value, 64); err == nil {
+				progress.FPS = fps
+			}
+		case "speed":
+			if speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+				progress.Speed = speed
+			}
+		case "progress":
+			now := time.Now()
+			if value == "end" || now.Sub(last) >= interval {
+				last = now
+				fn(progress)
+			}
+		}
+	}
+}
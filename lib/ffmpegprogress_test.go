@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProgress(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		interval time.Duration
+		want     []FFMpegProgress
+	}{
+		{
+			name:   "block",
+			output: "frame=50\nfps=25.00\nout_time_us=1500000\nspeed=1.5x\nprogress=end\n",
+			want:   []FFMpegProgress{{OutTime: 1500 * time.Millisecond, FPS: 25, Speed: 1.5}},
+		},
+		{
+			name:   "out_time_ms in microseconds",
+			output: "out_time_ms=2000000\nprogress=end\n",
+			want:   []FFMpegProgress{{OutTime: 2 * time.Second}},
+		},
+		{
+			name:   "values not available yet",
+			output: "fps=0.00\nout_time_us=N/A\nspeed=N/A\nprogress=continue\n",
+			want:   []FFMpegProgress{{}},
+		},
+		{
+			name:   "negative out time",
+			output: "out_time_us=-23220\nprogress=continue\n",
+			want:   []FFMpegProgress{{}},
+		},
+		{
+			name:   "blocks keep the values",
+			output: "out_time_us=1000000\nspeed=2x\nprogress=continue\nout_time_us=3000000\nprogress=end\n",
+			want: []FFMpegProgress{
+				{OutTime: time.Second, Speed: 2},
+				{OutTime: 3 * time.Second, Speed: 2},
+			},
+		},
+		{
+			name: "throttled but the last block",
+			output: "out_time_us=1000000\nprogress=continue\n" +
+				"out_time_us=2000000\nprogress=continue\n" +
+				"out_time_us=3000000\nprogress=end\n",
+			interval: time.Hour,
+			want: []FFMpegProgress{
+				{OutTime: time.Second},
+				{OutTime: 3 * time.Second},
+			},
+		},
+		{
+			name:   "garbage",
+			output: "Press [q] to stop\n\n=\nspeed\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []FFMpegProgress
+			parseProgress(strings.NewReader(tt.output), tt.interval, func(progress FFMpegProgress) {
+				got = append(got, progress)
+			})
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
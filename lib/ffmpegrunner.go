@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	ffmpeg_go "github.com/u2takey/ffmpeg-go"
+)
+
+var ErrCancelled = errors.New("task is cancelled")
+
+// cancelled task ids are kept for a while to drop their late messages
+const cancelledTTL = time.Hour * 24
+
+// FFMpegRunner runs ffmpeg processes on behalf of tasks and kills them
+// when their task gets cancelled. The zero value is ready to use.
+type FFMpegRunner struct {
+	mu        sync.Mutex
+	seq       int
+	running   map[string]map[int]context.CancelFunc
+	cancelled map[string]time.Time
+}
+
+// Run runs the stream and waits for it to finish. It returns ErrCancelled
+// if the task is cancelled before or while ffmpeg is running.
+func (r *FFMpegRunner) Run(id string, stream *ffmpeg_go.Stream) error {
+	ctx, cancel := context.WithCancel(stream.Context)
+	defer cancel()
+
+	key, ok := r.track(id, cancel)
+	if !ok {
+		return ErrCancelled
+	}
+	defer r.untrack(id, key)
+
+	stream.Context = ctx
+	err := stream.Run()
+	if r.IsCancelled(id) {
+		return ErrCancelled
+	}
+
+	return err
+}
+
+// RunWithProgress runs the stream like Run and reports the ffmpeg progress
+// to fn every couple of seconds.
+func (r *FFMpegRunner) RunWithProgress(id string, stream *ffmpeg_go.Stream, fn func(progress FFMpegProgress)) error {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	// GlobalArgs makes a new stream, so the settings have to be copied
+	ps := stream.GlobalArgs("-progress", "pipe:1", "-nostats")
+	ps.Context = stream.Context
+	ps.WithOutput(pw)
+
+	done := make(chan bool)
+	go func() {
+		parseProgress(pr, progressInterval, fn)
+		io.Copy(io.Discard, pr)
+		close(done)
+	}()
+
+	err := r.Run(id, ps)
+	pw.Close()
+	<-done
+
+	return err
+}
+
+// Cancel kills the running processes of the task and makes all further
+// Run calls for it fail.
+func (r *FFMpegRunner) Cancel(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	now := time.Now()
+	for cid, t := range r.cancelled {
+		if now.Sub(t) > cancelledTTL {
+			delete(r.cancelled, cid)
+		}
+	}
+	r.cancelled[id] = now
+
+	for _, cancel := range r.running[id] {
+		cancel()
+	}
+}
+
+func (r *FFMpegRunner) IsCancelled(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.cancelled[id]
+	return ok
+}
+
+func (r *FFMpegRunner) init() {
+	if r.running == nil {
+		r.running = make(map[string]map[int]context.CancelFunc)
+		r.cancelled = make(map[string]time.Time)
+	}
+}
+
+func (r *FFMpegRunner) track(id string, cancel context.CancelFunc) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	if _, ok := r.cancelled[id]; ok {
+		return 0, false
+	}
+
+	r.seq++
+	if r.running[id] == nil {
+		r.running[id] = make(map[int]context.CancelFunc)
+	}
+	r.running[id][r.seq] = cancel
+
+	return r.seq, true
+}
+
+func (r *FFMpegRunner) untrack(id string, key int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.running[id], key)
+	if len(r.running[id]) == 0 {
+		delete(r.running, id)
+	}
+}
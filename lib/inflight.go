@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// handled message ids are kept for a while to drop their late redeliveries
+const handledTTL = time.Hour
+
+// InFlight keeps the messages of the running jobs alive by touching them,
+// so the transport does not redeliver them while ffmpeg is still running. It also
+// detects the redeliveries which happen anyway. The zero value is ready to
+// use with the default touch interval.
+type InFlight struct {
+	TouchInterval time.Duration
+
+	mu      sync.Mutex
+	running map[string]*Message
+	stop    map[string]chan bool
+	handled map[string]time.Time
+}
+
+// Begin starts touching the message. It returns false for a redelivery of
+// a message which is being handled or has been handled already. The
+// redelivery of a running message takes its place, see Latest; the one of
+// a handled message is finished right away.
+func (f *InFlight) Begin(message *Message) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	if _, ok := f.handled[message.ID]; ok {
+		message.Finish()
+		return false
+	}
+
+	if _, ok := f.running[message.ID]; ok {
+		message.DisableAutoResponse()
+		f.running[message.ID] = message
+		return false
+	}
+
+	stop := make(chan bool)
+	f.running[message.ID] = message
+	f.stop[message.ID] = stop
+	go f.touch(message.ID, stop)
+
+	return true
+}
+
+// Latest returns the latest delivery of the message, the one to respond to.
+func (f *InFlight) Latest(message *Message) *Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if latest, ok := f.running[message.ID]; ok {
+		return latest
+	}
+	return message
+}
+
+// End stops touching the message. A handled message is finished for good,
+// otherwise it is going to be requeued and its redelivery is expected.
+func (f *InFlight) End(message *Message, handled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	if stop, ok := f.stop[message.ID]; ok {
+		close(stop)
+	}
+	delete(f.running, message.ID)
+	delete(f.stop, message.ID)
+
+	now := time.Now()
+	for id, t := range f.handled {
+		if now.Sub(t) > handledTTL {
+			delete(f.handled, id)
+		}
+	}
+	if handled {
+		f.handled[message.ID] = now
+	}
+}
+
+func (f *InFlight) init() {
+	if f.running == nil {
+		f.running = make(map[string]*Message)
+		f.stop = make(map[string]chan bool)
+		f.handled = make(map[string]time.Time)
+	}
+}
+
+func (f *InFlight) touch(id string, stop chan bool) {
+	interval := f.TouchInterval
+	if interval <= 0 {
+		interval = defaultMsgTimeout / 3
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			message := f.running[id]
+			f.mu.Unlock()
+
+			if message != nil {
+				message.Touch()
+			}
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package lib
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// the delay of the messages requeued by the handler errors
+const memoryRequeueDelay = 5 * time.Second
+
+// MemoryTransport is the in-process Transport. It follows the nsq
+// semantics: every channel of a topic gets a copy of each message, the
+// subscriptions of a channel share its messages, the messages published
+// before a topic has a channel are kept for the first one, and the
+// ephemeral topics and channels are gone with their last subscription.
+// Nothing is persisted and the messages in flight never time out.
+type MemoryTransport struct {
+	mu      sync.Mutex
+	topics  map[string]*memoryTopic
+	stopped bool
+}
+
+type memoryTopic struct {
+	channels map[string]*memoryChannel
+	// the messages waiting for the first channel
+	pending []*memoryMessage
+}
+
+type memoryMessage struct {
+	id        string
+	body      []byte
+	attempts  uint16
+	timestamp time.Time
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{topics: make(map[string]*memoryTopic)}
+}
+
+func (t *MemoryTransport) Connect() error {
+	return nil
+}
+
+func (t *MemoryTransport) Durable() bool {
+	return false
+}
+
+func (t *MemoryTransport) Publish(topic string, body []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return ErrTransportStopped
+	}
+
+	id := uuid.New().String()
+	now := time.Now()
+
+	mt := t.topic(topic)
+	if len(mt.channels) == 0 {
+		mt.pending = append(mt.pending, &memoryMessage{id: id, body: body, timestamp: now})
+		return nil
+	}
+
+	for _, channel := range mt.channels {
+		channel.push(&memoryMessage{id: id, body: body, timestamp: now})
+	}
+	return nil
+}
+
+func (t *MemoryTransport) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	t.mu.Lock()
+	stopped := t.stopped
+	t.mu.Unlock()
+
+	if stopped {
+		return ErrTransportStopped
+	}
+
+	time.AfterFunc(delay, func() {
+		t.Publish(topic, body)
+	})
+	return nil
+}
+
+func (t *MemoryTransport) Subscribe(config *SubscribeConfig, handler Handler) (Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return nil, ErrTransportStopped
+	}
+
+	mt := t.topic(config.Topic)
+	name := config.channel()
+	channel, ok := mt.channels[name]
+	if !ok {
+		channel = &memoryChannel{subscriptions: make(map[*memorySubscription]bool)}
+		channel.cond = sync.NewCond(&channel.mu)
+		mt.channels[name] = channel
+
+		for _, message := range mt.pending {
+			channel.push(message)
+		}
+		mt.pending = nil
+	}
+
+	s := &memorySubscription{
+		transport:   t,
+		topic:       config.Topic,
+		name:        name,
+		channel:     channel,
+		handler:     handler,
+		maxAttempts: config.MaxAttempts,
+		maxInFlight: config.maxInFlight(),
+	}
+
+	channel.mu.Lock()
+	channel.subscriptions[s] = true
+	channel.mu.Unlock()
+
+	for i := 0; i < config.concurrency(); i++ {
+		go s.run()
+	}
+
+	return s, nil
+}
+
+// Stop stops all the subscriptions, the messages left are dropped.
+func (t *MemoryTransport) Stop() {
+	t.mu.Lock()
+	t.stopped = true
+	var subscriptions []*memorySubscription
+	for _, mt := range t.topics {
+		for _, channel := range mt.channels {
+			channel.mu.Lock()
+			for s := range channel.subscriptions {
+				subscriptions = append(subscriptions, s)
+			}
+			channel.mu.Unlock()
+		}
+	}
+	t.mu.Unlock()
+
+	for _, s := range subscriptions {
+		s.Stop()
+	}
+}
+
+func (t *MemoryTransport) topic(name string) *memoryTopic {
+	mt, ok := t.topics[name]
+	if !ok {
+		mt = &memoryTopic{channels: make(map[string]*memoryChannel)}
+		t.topics[name] = mt
+	}
+	return mt
+}
+
+// unsubscribe removes the ephemeral channel and topic left without
+// subscriptions.
+func (t *MemoryTransport) unsubscribe(s *memorySubscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.channel.mu.Lock()
+	delete(s.channel.subscriptions, s)
+	empty := len(s.channel.subscriptions) == 0
+	s.channel.mu.Unlock()
+
+	mt, ok := t.topics[s.topic]
+	if !ok || !empty || !isEphemeral(s.name) {
+		return
+	}
+
+	delete(mt.channels, s.name)
+	if len(mt.channels) == 0 && isEphemeral(s.topic) {
+		delete(t.topics, s.topic)
+	}
+}
+
+func isEphemeral(name string) bool {
+	return strings.HasSuffix(name, "#ephemeral")
+}
+
+type memoryChannel struct {
+	mu            sync.Mutex
+	cond          *sync.Cond
+	queue         []*memoryMessage
+	subscriptions map[*memorySubscription]bool
+}
+
+func (c *memoryChannel) push(message *memoryMessage) {
+	c.mu.Lock()
+	c.queue = append(c.queue, message)
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// memorySubscription state is guarded by the channel lock.
+type memorySubscription struct {
+	transport   *MemoryTransport
+	topic       string
+	name        string
+	channel     *memoryChannel
+	handler     Handler
+	maxAttempts uint16
+	maxInFlight int
+	inFlight    int
+	stopped     bool
+}
+
+func (s *memorySubscription) ChangeMaxInFlight(maxInFlight int) {
+	s.channel.mu.Lock()
+	s.maxInFlight = maxInFlight
+	s.channel.mu.Unlock()
+	s.channel.cond.Broadcast()
+}
+
+func (s *memorySubscription) Stop() {
+	s.channel.mu.Lock()
+	if s.stopped {
+		s.channel.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	s.channel.mu.Unlock()
+	s.channel.cond.Broadcast()
+
+	s.transport.unsubscribe(s)
+}
+
+func (s *memorySubscription) run() {
+	c := s.channel
+	for {
+		c.mu.Lock()
+		for !s.stopped && (len(c.queue) == 0 || s.inFlight >= s.maxInFlight) {
+			c.cond.Wait()
+		}
+		if s.stopped {
+			c.mu.Unlock()
+			return
+		}
+
+		m := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		m.attempts++
+		s.inFlight++
+		c.mu.Unlock()
+
+		message := NewMessage(m.id, m.body, m.attempts, m.timestamp, &memoryMessageDelegate{s, m})
+
+		// nsq gives up the messages out of attempts the same way
+		if s.maxAttempts > 0 && m.attempts > s.maxAttempts {
+			message.Finish()
+			continue
+		}
+
+		handle(s.handler, message)
+	}
+}
+
+func (s *memorySubscription) done() {
+	s.channel.mu.Lock()
+	s.inFlight--
+	s.channel.mu.Unlock()
+	s.channel.cond.Broadcast()
+}
+
+type memoryMessageDelegate struct {
+	subscription *memorySubscription
+	message      *memoryMessage
+}
+
+func (d *memoryMessageDelegate) OnFinish(*Message) {
+	d.subscription.done()
+}
+
+func (d *memoryMessageDelegate) OnRequeue(_ *Message, delay time.Duration) {
+	d.subscription.done()
+
+	if delay < 0 {
+		delay = memoryRequeueDelay
+	}
+	if delay == 0 {
+		d.subscription.channel.push(d.message)
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		d.subscription.channel.push(d.message)
+	})
+}
+
+func (d *memoryMessageDelegate) OnTouch(*Message) {}
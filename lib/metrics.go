@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vconvd",
+		Name:      "stage_duration_seconds",
+		Help:      "Duration of the successful split, convert and join runs.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 14),
+	}, []string{"stage"})
+
+	realtimeFactor = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vconvd",
+		Name:      "ffmpeg_realtime_factor",
+		Help:      "Media time processed per second of the successful ffmpeg runs.",
+		Buckets:   []float64{0.25, 0.5, 1, 2, 4, 8, 16, 32, 64, 128},
+	}, []string{"stage"})
+
+	messageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vconvd",
+		Name:      "message_errors_total",
+		Help:      "Messages rejected or failed by the manager and the workers.",
+	}, []string{"component", "name"})
+)
+
+// ObserveStage records a successful run of the stage. The realtime factor
+// is the ffmpeg speed of the last progress report, zero if there was none.
+func ObserveStage(stage string, started time.Time, speed float64) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(started).Seconds())
+	if speed > 0 {
+		realtimeFactor.WithLabelValues(stage).Observe(speed)
+	}
+}
+
+// CountMessageError counts a message the component failed to handle. The
+// name is the message name, or empty if the message can not be decoded.
+func CountMessageError(component string, name string) {
+	if name == "" {
+		name = "malformed"
+	}
+	messageErrors.WithLabelValues(component, name).Inc()
+}
+
+// ServeMetrics serves the prometheus metrics at the address on /metrics.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return http.ListenAndServe(addr, mux)
+}
@@ -2,26 +2,120 @@ package lib
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	nsq "github.com/nsqio/go-nsq"
 )
 
+const defaultChannel = "put"
+
+// the msg-timeout default of nsqd, nsq leaves the timeout to the server
+const defaultMsgTimeout = time.Minute
+
+// the nsqd unreachable on connecting are retried this often
+const nsqdRetryInterval = 15 * time.Second
+
 type NsqConsumer struct {
-	Host  string
-	Port  int
-	Topic string
-	Nsqc  *nsq.Consumer
-	Log   bool
+	Host string
+	Port int
+	// Addresses of the nsqd to consume from, Host and Port are used if empty
+	Addresses []string
+	// LookupdHTTPAddresses to discover the nsqd, the nsqd addresses are
+	// ignored if any unless Direct is set
+	LookupdHTTPAddresses []string
+	// Direct connects the nsqd addresses along with the lookupd
+	Direct  bool
+	Topic   string
+	Channel string
+	// MaxAttempts of a message, nsq default is used if zero
+	MaxAttempts uint16
+	// MsgTimeout is the time a message may be in flight without touching,
+	// nsq default is used if zero. It is limited by the nsqd max-msg-timeout.
+	MsgTimeout time.Duration
+	// MaxInFlight messages, nsq default is used if zero
+	MaxInFlight int
+	Nsqc        *nsq.Consumer
+	Log         bool
 }
 
 func (c *NsqConsumer) Setup() error {
 	cfg := nsq.NewConfig()
+	if c.MaxAttempts > 0 {
+		cfg.MaxAttempts = c.MaxAttempts
+	}
+	if c.MsgTimeout > 0 {
+		cfg.MsgTimeout = c.MsgTimeout
+	}
+	if c.MaxInFlight > 0 {
+		cfg.MaxInFlight = c.MaxInFlight
+	}
+
+	channel := c.Channel
+	if channel == "" {
+		channel = defaultChannel
+	}
 
 	var err error
-	c.Nsqc, err = nsq.NewConsumer(c.Topic, "put", cfg)
+	c.Nsqc, err = nsq.NewConsumer(c.Topic, channel, cfg)
 	return err
 }
 
 func (c *NsqConsumer) Connect() error {
-	return c.Nsqc.ConnectToNSQD(fmt.Sprintf("%s:%d", c.Host, c.Port))
+	if len(c.LookupdHTTPAddresses) > 0 {
+		if c.Direct {
+			// the lookupd are used for the rest of the nsqd
+			c.connectNsqds()
+		}
+		return c.Nsqc.ConnectToNSQLookupds(c.LookupdHTTPAddresses)
+	}
+
+	return c.connectNsqds()
+}
+
+// connectNsqds connects the nsqd addresses, it fails if none of them is
+// reachable. The unreachable ones are retried until they are up.
+func (c *NsqConsumer) connectNsqds() error {
+	addrs := c.Addresses
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf("%s:%d", c.Host, c.Port)}
+	}
+
+	var failed, errs []string
+	for _, addr := range addrs {
+		err := c.Nsqc.ConnectToNSQD(addr)
+		if err != nil && err != nsq.ErrAlreadyConnected {
+			failed = append(failed, addr)
+			errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+		}
+	}
+
+	if len(failed) == len(addrs) {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	if len(failed) > 0 {
+		go c.retry(failed)
+	}
+	return nil
+}
+
+// retry connects the nsqd down at startup once they are up, nsq only
+// reconnects the ones it has been connected to.
+func (c *NsqConsumer) retry(addrs []string) {
+	for len(addrs) > 0 {
+		select {
+		case <-c.Nsqc.StopChan:
+			return
+		case <-time.After(nsqdRetryInterval):
+		}
+
+		var failed []string
+		for _, addr := range addrs {
+			err := c.Nsqc.ConnectToNSQD(addr)
+			if err != nil && err != nsq.ErrAlreadyConnected {
+				failed = append(failed, addr)
+			}
+		}
+		addrs = failed
+	}
 }
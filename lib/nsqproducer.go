@@ -2,26 +2,100 @@ package lib
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nsqio/go-nsq"
 )
 
+// NsqProducer publishes to the first nsqd of Addresses which accepts the
+// message, falling over to the next one on errors. Host and Port are used
+// if there are no Addresses.
 type NsqProducer struct {
-	Host string
-	Port int
-	Nsqp *nsq.Producer
-	Log  bool
+	Host      string
+	Port      int
+	Addresses []string
+	Log       bool
+
+	mu        sync.Mutex
+	producers []*nsq.Producer
+	current   int
 }
 
+// Setup fails if none of the nsqd is reachable. The unreachable ones are
+// retried on publishing.
 func (p *NsqProducer) Setup() error {
 	cfg := nsq.NewConfig()
-	p.Nsqp, _ = nsq.NewProducer(fmt.Sprintf("%s:%d", p.Host, p.Port), cfg)
-	if !p.Log {
-		p.Nsqp.SetLogger(nil, 0)
+
+	var errs []string
+	for _, addr := range p.addresses() {
+		producer, err := nsq.NewProducer(addr, cfg)
+		if err != nil {
+			return err
+		}
+		if !p.Log {
+			producer.SetLogger(nil, 0)
+		}
+		p.producers = append(p.producers, producer)
+
+		err = producer.Ping()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", addr, err))
+		}
+	}
+
+	if len(errs) == len(p.producers) {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (p *NsqProducer) Publish(topic string, body []byte) error {
+	return p.failover(func(producer *nsq.Producer) error {
+		return producer.Publish(topic, body)
+	})
+}
+
+func (p *NsqProducer) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	return p.failover(func(producer *nsq.Producer) error {
+		return producer.DeferredPublish(topic, delay, body)
+	})
+}
+
+// failover publishes with the producer succeeded last, the rest of them
+// are tried in turn if it fails.
+func (p *NsqProducer) failover(publish func(producer *nsq.Producer) error) error {
+	p.mu.Lock()
+	current := p.current
+	p.mu.Unlock()
+
+	var err error
+	for i := range p.producers {
+		n := (current + i) % len(p.producers)
+		err = publish(p.producers[n])
+		if err == nil {
+			if n != current {
+				p.mu.Lock()
+				p.current = n
+				p.mu.Unlock()
+			}
+			return nil
+		}
 	}
-	return p.Nsqp.Ping()
+
+	return err
 }
 
 func (p *NsqProducer) Stop() {
-	p.Nsqp.Stop()
+	for _, producer := range p.producers {
+		producer.Stop()
+	}
+}
+
+func (p *NsqProducer) addresses() []string {
+	if len(p.Addresses) > 0 {
+		return p.Addresses
+	}
+	return []string{fmt.Sprintf("%s:%d", p.Host, p.Port)}
 }
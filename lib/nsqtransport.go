@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// NsqTransport is the Transport over nsqd. The messages are published to
+// one of the nsqd, see NsqProducer, and consumed from all of them, either
+// listed or discovered by nsqlookupd.
+type NsqTransport struct {
+	Host                 string
+	Port                 int
+	Addresses            []string
+	LookupdHTTPAddresses []string
+	Log                  bool
+	producer             *NsqProducer
+}
+
+// Connect connects the producer. The consumers connect on subscribing.
+func (t *NsqTransport) Connect() error {
+	t.producer = &NsqProducer{
+		Host:      t.Host,
+		Port:      t.Port,
+		Addresses: t.Addresses,
+		Log:       t.Log,
+	}
+
+	return t.producer.Setup()
+}
+
+// Durable reports true, the messages are queued by nsqd.
+func (t *NsqTransport) Durable() bool {
+	return true
+}
+
+func (t *NsqTransport) Publish(topic string, body []byte) error {
+	return t.producer.Publish(topic, body)
+}
+
+func (t *NsqTransport) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	return t.producer.DeferredPublish(topic, delay, body)
+}
+
+func (t *NsqTransport) Subscribe(config *SubscribeConfig, handler Handler) (Subscription, error) {
+	consumer := &NsqConsumer{
+		Host:                 t.Host,
+		Port:                 t.Port,
+		Addresses:            t.Addresses,
+		LookupdHTTPAddresses: t.LookupdHTTPAddresses,
+		Direct:               config.Direct,
+		Topic:                config.Topic,
+		Channel:              config.channel(),
+		MaxAttempts:          config.MaxAttempts,
+		MsgTimeout:           config.MsgTimeout,
+		MaxInFlight:          config.maxInFlight(),
+		Log:                  t.Log,
+	}
+
+	err := consumer.Setup()
+	if err != nil {
+		return nil, err
+	}
+
+	consumer.Nsqc.AddConcurrentHandlers(nsq.HandlerFunc(func(message *nsq.Message) error {
+		// the responses are sent by the Message, see handle
+		message.DisableAutoResponse()
+		return handle(handler, NewMessage(string(message.ID[:]), message.Body, message.Attempts,
+			time.Unix(0, message.Timestamp), nsqMessageDelegate{message}))
+	}), config.concurrency())
+
+	err = consumer.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nsqSubscription{consumer}, nil
+}
+
+// String returns the nsqd addresses the messages are published to.
+func (t *NsqTransport) String() string {
+	if len(t.Addresses) > 0 {
+		return strings.Join(t.Addresses, ", ")
+	}
+	return fmt.Sprintf("%s:%d", t.Host, t.Port)
+}
+
+func (t *NsqTransport) Stop() {
+	if t.producer != nil {
+		t.producer.Stop()
+	}
+}
+
+type nsqSubscription struct {
+	consumer *NsqConsumer
+}
+
+func (s *nsqSubscription) ChangeMaxInFlight(maxInFlight int) {
+	s.consumer.Nsqc.ChangeMaxInFlight(maxInFlight)
+}
+
+func (s *nsqSubscription) Stop() {
+	s.consumer.Nsqc.Stop()
+}
+
+type nsqMessageDelegate struct {
+	message *nsq.Message
+}
+
+func (d nsqMessageDelegate) OnFinish(*Message) {
+	d.message.Finish()
+}
+
+func (d nsqMessageDelegate) OnRequeue(_ *Message, delay time.Duration) {
+	// go-nsq computes the delay of -1 only, nsqd rejects the other
+	// negative ones
+	if delay < 0 {
+		delay = -1
+	}
+	d.message.RequeueWithoutBackoff(delay)
+}
+
+func (d nsqMessageDelegate) OnTouch(*Message) {
+	d.message.Touch()
+}
@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+type nsqRequeueRecorder struct {
+	delay time.Duration
+}
+
+func (r *nsqRequeueRecorder) OnFinish(*nsq.Message) {}
+
+func (r *nsqRequeueRecorder) OnRequeue(_ *nsq.Message, delay time.Duration, _ bool) {
+	r.delay = delay
+}
+
+func (r *nsqRequeueRecorder) OnTouch(*nsq.Message) {}
+
+func TestNsqRequeueDelay(t *testing.T) {
+	tests := []struct {
+		delay time.Duration
+		want  time.Duration
+	}{
+		{delay: time.Second, want: time.Second},
+		{delay: 0, want: 0},
+		{delay: -1, want: -1},
+		{delay: -time.Second, want: -1},
+	}
+
+	for _, tt := range tests {
+		recorder := &nsqRequeueRecorder{}
+		message := nsq.NewMessage(nsq.MessageID{}, nil)
+		message.Delegate = recorder
+
+		nsqMessageDelegate{message: message}.OnRequeue(nil, tt.delay)
+		if recorder.delay != tt.want {
+			t.Errorf("Requeue(%s) requeued in %s, want %s", tt.delay, recorder.delay, tt.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"time"
+
+	"vconvd/logger"
+)
+
+var log = logger.Log
+
+// RetryPolicy requeues the failed messages with an exponential backoff
+// until they run out of attempts.
+type RetryPolicy struct {
+	// MaxAttempts of a message, at least one, as every attempt is the last
+	// one otherwise
+	MaxAttempts uint16
+	Delay       time.Duration
+	MaxDelay    time.Duration
+}
+
+// IsLastAttempt reports whether the message must not be requeued anymore.
+func (p *RetryPolicy) IsLastAttempt(message *Message) bool {
+	return message.Attempts >= p.MaxAttempts
+}
+
+// Requeue puts the message back to the queue to be retried later.
+func (p *RetryPolicy) Requeue(message *Message) time.Duration {
+	delay := p.Delay
+	for i := uint16(1); i < message.Attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	message.Requeue(delay)
+	return delay
+}
+
+// Settle responds to the handled message and stops keeping it in flight.
+// The message may have been redelivered while it was handled, so the
+// latest delivery is responded to. A failed message is requeued until it
+// runs out of attempts, then giveUp reports the error and dead letters it.
+func (p *RetryPolicy) Settle(inflight *InFlight, message *Message, err error, giveUp func(latest *Message)) {
+	latest := inflight.Latest(message)
+	last := p.IsLastAttempt(latest)
+	inflight.End(message, err == nil || last)
+
+	if err == nil {
+		latest.Finish()
+		return
+	}
+
+	if !last {
+		delay := p.Requeue(latest)
+		log.Warningf("%s - attempt %d, retry in %s", err, latest.Attempts, delay)
+		return
+	}
+
+	log.Errorf("%s - giving up after %d attempts", err, latest.Attempts)
+	giveUp(latest)
+	latest.Finish()
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type requeueRecorder struct {
+	delay     time.Duration
+	requeued  bool
+	responses int
+}
+
+func (r *requeueRecorder) OnFinish(message *Message) {
+	r.responses++
+}
+
+func (r *requeueRecorder) OnRequeue(message *Message, delay time.Duration) {
+	r.delay, r.requeued = delay, true
+	r.responses++
+}
+
+func (r *requeueRecorder) OnTouch(message *Message) {}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 5, Delay: time.Second, MaxDelay: 10 * time.Second}
+
+	tests := []struct {
+		attempts uint16
+		last     bool
+		delay    time.Duration
+	}{
+		{attempts: 1, delay: time.Second},
+		{attempts: 2, delay: 2 * time.Second},
+		{attempts: 3, delay: 4 * time.Second},
+		{attempts: 4, delay: 8 * time.Second},
+		{attempts: 5, last: true, delay: 10 * time.Second},
+		{attempts: 40, last: true, delay: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		recorder := &requeueRecorder{}
+		message := NewMessage("id", nil, tt.attempts, time.Now(), recorder)
+
+		if last := policy.IsLastAttempt(message); last != tt.last {
+			t.Errorf("attempt %d: IsLastAttempt() = %t, want %t", tt.attempts, last, tt.last)
+		}
+
+		delay := policy.Requeue(message)
+		if delay != tt.delay || recorder.delay != tt.delay {
+			t.Errorf("attempt %d: requeued in %s (%s returned), want %s", tt.attempts, recorder.delay, delay, tt.delay)
+		}
+		if !recorder.requeued || recorder.responses != 1 {
+			t.Errorf("attempt %d: %d responses, want a single requeue", tt.attempts, recorder.responses)
+		}
+	}
+}
+
+func TestRetryPolicySettle(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3, Delay: time.Second, MaxDelay: 10 * time.Second}
+	failure := errors.New("failure")
+
+	tests := []struct {
+		attempts uint16
+		err      error
+		requeued bool
+		gaveUp   bool
+	}{
+		{attempts: 1},
+		{attempts: 1, err: failure, requeued: true},
+		{attempts: 2, err: failure, requeued: true},
+		{attempts: 3, err: failure, gaveUp: true},
+	}
+
+	for _, tt := range tests {
+		recorder := &requeueRecorder{}
+		message := NewMessage("id", nil, tt.attempts, time.Now(), recorder)
+		inflight := &InFlight{TouchInterval: time.Minute}
+		inflight.Begin(message)
+
+		var gaveUp bool
+		policy.Settle(inflight, message, tt.err, func(latest *Message) {
+			if latest != message {
+				t.Errorf("attempt %d: gave up another message", tt.attempts)
+			}
+			gaveUp = true
+		})
+
+		if recorder.requeued != tt.requeued || gaveUp != tt.gaveUp {
+			t.Errorf("attempt %d, error %v: requeued %t, gave up %t, want %t and %t",
+				tt.attempts, tt.err, recorder.requeued, gaveUp, tt.requeued, tt.gaveUp)
+		}
+		if recorder.responses != 1 {
+			t.Errorf("attempt %d, error %v: %d responses, want one", tt.attempts, tt.err, recorder.responses)
+		}
+	}
+}
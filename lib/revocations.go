@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// revoked attempts are kept for a while to drop their late messages
+const revokedTTL = time.Hour * 24
+
+// Revocations cancels the chunk runs of the attempts the manager has given
+// out again, and drops the messages of them received later. The zero value
+// is ready to use.
+type Revocations struct {
+	mu      sync.Mutex
+	revoked map[string]revocation
+	running map[string]map[int]context.CancelFunc
+}
+
+type revocation struct {
+	attempt int
+	at      time.Time
+}
+
+// Begin starts the run of the chunk attempt. The returned context derives
+// from the parent and is cancelled once the attempt is revoked. It returns
+// false if the attempt is revoked already.
+func (r *Revocations) Begin(parent context.Context, id string, sequence uint32, attempt int) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	key := chunkKey(id, sequence)
+	if r.isRevoked(key, attempt) {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	if r.running[key] == nil {
+		r.running[key] = make(map[int]context.CancelFunc)
+	}
+	r.running[key][attempt] = cancel
+
+	return ctx, true
+}
+
+// End releases the run of the chunk attempt.
+func (r *Revocations) End(id string, sequence uint32, attempt int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := chunkKey(id, sequence)
+	if cancel, ok := r.running[key][attempt]; ok {
+		cancel()
+	}
+	delete(r.running[key], attempt)
+	if len(r.running[key]) == 0 {
+		delete(r.running, key)
+	}
+}
+
+// Revoke cancels the runs of the chunk attempt and the earlier ones.
+func (r *Revocations) Revoke(id string, sequence uint32, attempt int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	now := time.Now()
+	for key, rev := range r.revoked {
+		if now.Sub(rev.at) > revokedTTL {
+			delete(r.revoked, key)
+		}
+	}
+
+	key := chunkKey(id, sequence)
+	if rev, ok := r.revoked[key]; !ok || rev.attempt < attempt {
+		r.revoked[key] = revocation{attempt: attempt, at: now}
+	}
+
+	for running, cancel := range r.running[key] {
+		if running <= attempt {
+			cancel()
+		}
+	}
+}
+
+func (r *Revocations) IsRevoked(id string, sequence uint32, attempt int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.isRevoked(chunkKey(id, sequence), attempt)
+}
+
+func (r *Revocations) isRevoked(key string, attempt int) bool {
+	rev, ok := r.revoked[key]
+	return ok && attempt <= rev.attempt
+}
+
+func (r *Revocations) init() {
+	if r.running == nil {
+		r.running = make(map[string]map[int]context.CancelFunc)
+		r.revoked = make(map[string]revocation)
+	}
+}
+
+func chunkKey(id string, sequence uint32) string {
+	return fmt.Sprintf("%s_%d", id, sequence)
+}
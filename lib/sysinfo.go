@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SystemInfo describes the host a worker runs on.
+type SystemInfo struct {
+	Hostname      string
+	CPUCount      int
+	FreeMemory    uint64
+	FreeDisk      uint64
+	FFMpegVersion string
+	Encoders      []string
+	Decoders      []string
+}
+
+var (
+	ffmpegInfoOnce sync.Once
+	ffmpegVersion  string
+	ffmpegEncoders []string
+	ffmpegDecoders []string
+)
+
+// GetSystemInfo collects the host resources and the ffmpeg capabilities.
+// Free disk space is the one of the given path. ffmpeg is asked once, the
+// rest is collected on every call.
+func GetSystemInfo(path string) SystemInfo {
+	ffmpegInfoOnce.Do(func() {
+		ffmpegVersion = getFFMpegVersion()
+		ffmpegEncoders = getFFMpegCodecs("-encoders")
+		ffmpegDecoders = getFFMpegCodecs("-decoders")
+	})
+
+	hostname, _ := os.Hostname()
+
+	return SystemInfo{
+		Hostname:      hostname,
+		CPUCount:      runtime.NumCPU(),
+		FreeMemory:    getFreeMemory(),
+		FreeDisk:      getFreeDisk(path),
+		FFMpegVersion: ffmpegVersion,
+		Encoders:      ffmpegEncoders,
+		Decoders:      ffmpegDecoders,
+	}
+}
+
+func getFFMpegVersion() string {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-version").Output()
+	if err != nil {
+		return ""
+	}
+
+	// ffmpeg version 4.4.2 Copyright (c) 2000-2021 the FFmpeg developers
+	fields := strings.Fields(strings.SplitN(string(out), "\n", 2)[0])
+	if len(fields) < 3 {
+		return ""
+	}
+
+	return fields[2]
+}
+
+// getFFMpegCodecs parses the output of ffmpeg -encoders or -decoders:
+// a legend, a " ------" line and then a "<flags> <name> <description>"
+// line per codec.
+func getFFMpegCodecs(arg string) []string {
+	out, err := exec.Command("ffmpeg", "-hide_banner", arg).Output()
+	if err != nil {
+		return nil
+	}
+
+	var codecs []string
+	list := false
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !list {
+			list = strings.HasPrefix(line, "---")
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			codecs = append(codecs, fields[1])
+		}
+	}
+
+	return codecs
+}
+
+func getFreeMemory() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	// MemAvailable:    8037720 kB
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+
+	return 0
+}
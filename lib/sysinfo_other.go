@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package lib
+
+func getFreeDisk(path string) uint64 {
+	return 0
+}
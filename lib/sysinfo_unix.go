@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package lib
+
+import "syscall"
+
+func getFreeDisk(path string) uint64 {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0
+	}
+
+	// the field types differ between the platforms
+	return uint64(stat.Bavail) * uint64(stat.Bsize)
+}
@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrTransportStopped = errors.New("transport is stopped")
+
+// Transport carries the messages between the manager and the workers.
+// The manager and the workers connect an NsqTransport of their config
+// unless their Transport field is set, e.g. to share a MemoryTransport.
+type Transport interface {
+	Connect() error
+	Publish(topic string, body []byte) error
+	DeferredPublish(topic string, delay time.Duration, body []byte) error
+	Subscribe(config *SubscribeConfig, handler Handler) (Subscription, error)
+	// Durable reports whether the queued messages outlive the restarts of
+	// the manager and the workers
+	Durable() bool
+	Stop()
+}
+
+// Handler handles the messages of a subscription. The message is finished
+// once the handler returns nil and requeued on error, unless the handler
+// has responded to it already or disabled the auto response.
+type Handler func(message *Message) error
+
+// Subscription is the consumption of a topic channel.
+type Subscription interface {
+	// ChangeMaxInFlight changes the number of messages handled at once,
+	// zero pauses the subscription.
+	ChangeMaxInFlight(maxInFlight int)
+	Stop()
+}
+
+type SubscribeConfig struct {
+	Topic   string
+	Channel string
+	// MaxAttempts of a message, the transport default is used if zero
+	MaxAttempts uint16
+	// MsgTimeout is the time a message may be in flight without touching,
+	// the transport default is used if zero
+	MsgTimeout time.Duration
+	// MaxInFlight messages, one if zero
+	MaxInFlight int
+	// Concurrency is the number of the handlers running at once, one if zero
+	Concurrency int
+	// Direct subscriptions are consumed from the nsqd addresses at once
+	// rather than once nsqlookupd is polled again, e.g. for the topics the
+	// manager has not published to yet. The subscription creates the topic.
+	Direct bool
+}
+
+// TouchInterval returns how often the in-flight messages should be
+// touched to stay within the message timeout.
+func (c *SubscribeConfig) TouchInterval() time.Duration {
+	timeout := c.MsgTimeout
+	if timeout <= 0 {
+		timeout = defaultMsgTimeout
+	}
+
+	return timeout / 3
+}
+
+func (c *SubscribeConfig) channel() string {
+	if c.Channel == "" {
+		return defaultChannel
+	}
+	return c.Channel
+}
+
+// BroadcastChannel returns a channel of its own for the subscriber. Every
+// channel gets a copy of each message, so the subscriber gets all the
+// messages of the topic rather than its share of them.
+func BroadcastChannel() string {
+	return uuid.New().String() + "#ephemeral"
+}
+
+func (c *SubscribeConfig) maxInFlight() int {
+	if c.MaxInFlight < 1 {
+		return 1
+	}
+	return c.MaxInFlight
+}
+
+func (c *SubscribeConfig) concurrency() int {
+	if c.Concurrency < 1 {
+		return 1
+	}
+	return c.Concurrency
+}
+
+// MessageDelegate responds to the messages on behalf of the transport.
+type MessageDelegate interface {
+	OnFinish(message *Message)
+	OnRequeue(message *Message, delay time.Duration)
+	OnTouch(message *Message)
+}
+
+// Message is a message delivered by a Transport. Attempts counts the
+// deliveries, the first one included.
+type Message struct {
+	ID        string
+	Body      []byte
+	Attempts  uint16
+	Timestamp time.Time
+
+	delegate             MessageDelegate
+	responded            int32
+	autoResponseDisabled int32
+}
+
+func NewMessage(id string, body []byte, attempts uint16, timestamp time.Time, delegate MessageDelegate) *Message {
+	return &Message{
+		ID:        id,
+		Body:      body,
+		Attempts:  attempts,
+		Timestamp: timestamp,
+		delegate:  delegate,
+	}
+}
+
+// Finish removes the message from the queue.
+func (m *Message) Finish() {
+	if atomic.CompareAndSwapInt32(&m.responded, 0, 1) {
+		m.delegate.OnFinish(m)
+	}
+}
+
+// Requeue puts the message back to the queue to be delivered again after
+// the delay. Any negative delay makes the transport choose it, e.g. -1.
+func (m *Message) Requeue(delay time.Duration) {
+	if atomic.CompareAndSwapInt32(&m.responded, 0, 1) {
+		m.delegate.OnRequeue(m, delay)
+	}
+}
+
+// Touch resets the timeout of the message in flight.
+func (m *Message) Touch() {
+	if atomic.LoadInt32(&m.responded) == 0 {
+		m.delegate.OnTouch(m)
+	}
+}
+
+func (m *Message) HasResponded() bool {
+	return atomic.LoadInt32(&m.responded) == 1
+}
+
+// DisableAutoResponse leaves the response to the message to the caller
+// when the handler returns.
+func (m *Message) DisableAutoResponse() {
+	atomic.StoreInt32(&m.autoResponseDisabled, 1)
+}
+
+func (m *Message) IsAutoResponseDisabled() bool {
+	return atomic.LoadInt32(&m.autoResponseDisabled) == 1
+}
+
+// handle runs the handler and responds to the message on its behalf.
+func handle(handler Handler, message *Message) error {
+	err := handler(message)
+	if message.IsAutoResponseDisabled() || message.HasResponded() {
+		return err
+	}
+
+	if err != nil {
+		message.Requeue(-1)
+	} else {
+		message.Finish()
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	R "github.com/go-pkgz/rest"
+	"github.com/google/uuid"
+
+	"vconvd/model"
+)
+
+// the timeout of a delivery if none is configured
+const defaultCallbackTimeout = time.Second * 10
+
+type CallbackConfig struct {
+	MaxAttempts int
+	RetryDelay  time.Duration
+	MaxDelay    time.Duration
+	Timeout     time.Duration
+}
+
+// CallbackNotifier delivers the task events to the HTTP callbacks of the
+// task. Pending deliveries are kept in the database until they succeed or
+// run out of attempts, so they survive a restart of the manager. The tasks
+// are delivered to at once, the events of a task one by one in order.
+type CallbackNotifier struct {
+	config      *CallbackConfig
+	dataStorage *DataStorage
+	client      *http.Client
+	wakeChan    chan bool
+
+	mu sync.Mutex
+	// tasks having their callbacks delivered
+	delivering map[string]bool
+}
+
+func NewCallbackNotifier(config *CallbackConfig, dataStorage *DataStorage) *CallbackNotifier {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultCallbackTimeout
+	}
+
+	return &CallbackNotifier{
+		config:      config,
+		dataStorage: dataStorage,
+		client:      &http.Client{Timeout: timeout},
+		wakeChan:    make(chan bool, 1),
+		delivering:  make(map[string]bool),
+	}
+}
+
+// Notify stores a delivery of the event if the task has a callback URL
+// for it.
+func (n *CallbackNotifier) Notify(convtask *model.ConversionTask, event string) {
+	if convtask.HTTPCallbacks == nil {
+		return
+	}
+
+	url := convtask.HTTPCallbacks.URL(event)
+	if url == "" {
+		return
+	}
+
+	payload, err := json.Marshal(R.JSON{"event": event, "task": newTaskInfo(convtask)})
+	if err != nil {
+		log.Errorf("Failed to marshal the %s callback payload of the task %s: %s", event, convtask.ID, err)
+		return
+	}
+
+	now := time.Now()
+	callback := model.Callback{
+		ID:          uuid.New().String(),
+		TaskID:      convtask.ID,
+		Event:       event,
+		URL:         url,
+		Payload:     payload,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+
+	err = n.dataStorage.CreateCallback(&callback)
+	if err != nil {
+		log.Errorf("Failed to store the %s callback of the task %s: %s", event, convtask.ID, err)
+		return
+	}
+
+	select {
+	case n.wakeChan <- true:
+	default:
+	}
+}
+
+// Run delivers the due callbacks until done is closed. The deliveries in
+// progress are cancelled then and waited for.
+func (n *CallbackNotifier) Run(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	for {
+		callbacks, err := n.dataStorage.GetDueCallbacks(time.Now())
+		if err != nil {
+			log.Errorf("Failed to load pending callbacks: %s", err)
+		}
+
+		var tasks []string
+		byTask := make(map[string][]*model.Callback)
+		for _, callback := range callbacks {
+			if byTask[callback.TaskID] == nil {
+				tasks = append(tasks, callback.TaskID)
+			}
+			byTask[callback.TaskID] = append(byTask[callback.TaskID], callback)
+		}
+
+		for _, id := range tasks {
+			if !n.begin(id) {
+				continue
+			}
+
+			wg.Add(1)
+			go func(id string, callbacks []*model.Callback) {
+				defer wg.Done()
+				defer n.end(id)
+
+				for _, callback := range callbacks {
+					n.deliver(ctx, callback)
+				}
+			}(id, byTask[id])
+		}
+
+		select {
+		case <-done:
+			return
+		case <-n.wakeChan:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// begin marks the callbacks of the task as being delivered. It returns
+// false if they are already.
+func (n *CallbackNotifier) begin(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.delivering[id] {
+		return false
+	}
+	n.delivering[id] = true
+	return true
+}
+
+func (n *CallbackNotifier) end(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.delivering, id)
+}
+
+func (n *CallbackNotifier) deliver(ctx context.Context, callback *model.Callback) {
+	err := n.post(ctx, callback)
+	if err != nil && ctx.Err() != nil {
+		// the manager is stopping, the callback is delivered after the restart
+		return
+	}
+	if err == nil {
+		log.Debugf("Delivered the %s callback of the task %s", callback.Event, callback.TaskID)
+		err = n.dataStorage.DeleteCallback(callback)
+		if err != nil {
+			log.Errorf("Failed to delete the callback %s: %s", callback.ID, err)
+		}
+		return
+	}
+
+	callback.Attempts++
+	callback.LastError = err.Error()
+
+	if callback.Attempts >= n.config.MaxAttempts {
+		log.Errorf("Giving up the %s callback of the task %s after %d attempts: %s",
+			callback.Event, callback.TaskID, callback.Attempts, err)
+		callbackFailures.WithLabelValues("dropped").Inc()
+		err = n.dataStorage.DeleteCallback(callback)
+		if err != nil {
+			log.Errorf("Failed to delete the callback %s: %s", callback.ID, err)
+		}
+		return
+	}
+
+	callbackFailures.WithLabelValues("retried").Inc()
+
+	delay := n.backoff(callback.Attempts)
+	callback.NextAttempt = time.Now().Add(delay)
+	log.Warningf("Failed to deliver the %s callback of the task %s, retry in %s: %s",
+		callback.Event, callback.TaskID, delay, err)
+
+	err = n.dataStorage.UpdateCallback(callback)
+	if err != nil {
+		log.Errorf("Failed to update the callback %s: %s", callback.ID, err)
+	}
+}
+
+func (n *CallbackNotifier) backoff(attempts int) time.Duration {
+	delay := n.config.RetryDelay
+	for i := 1; i < attempts && delay < n.config.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > n.config.MaxDelay {
+		delay = n.config.MaxDelay
+	}
+
+	return delay
+}
+
+func (n *CallbackNotifier) post(ctx context.Context, callback *model.Callback) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback.URL, bytes.NewReader(callback.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"vconvd/model"
+)
+
+// TestCallbackNotifierHangingEndpoint checks a hanging endpoint neither
+// holds the callbacks of the other tasks nor the stop of the notifier.
+func TestCallbackNotifierHangingEndpoint(t *testing.T) {
+	d := openTestStorage(t)
+
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hanging.Close()
+	defer close(release)
+
+	delivered := make(chan string, 1)
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- r.URL.Path
+	}))
+	defer healthy.Close()
+
+	now := time.Now()
+	for _, callback := range []*model.Callback{
+		{ID: "1", TaskID: "hanging", URL: hanging.URL, CreatedAt: now, NextAttempt: now},
+		{ID: "2", TaskID: "healthy", URL: healthy.URL + "/healthy", CreatedAt: now.Add(time.Millisecond), NextAttempt: now},
+	} {
+		err := d.CreateCallback(callback)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := NewCallbackNotifier(&CallbackConfig{
+		MaxAttempts: 3,
+		RetryDelay:  time.Minute,
+		MaxDelay:    time.Minute,
+		Timeout:     time.Minute,
+	}, d)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n.Run(done)
+	}()
+
+	select {
+	case path := <-delivered:
+		if path != "/healthy" {
+			t.Errorf("Got the callback at %s, want /healthy", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The callback is held by the hanging endpoint")
+	}
+
+	// the delivered callback is deleted before the stop
+	var callbacks []*model.Callback
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var err error
+		callbacks, err = d.GetDueCallbacks(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(callbacks) == 1 {
+			break
+		}
+	}
+
+	close(done)
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The notifier is not stopped in time")
+	}
+
+	// the cancelled delivery is left for the next run
+	callbacks, err := d.GetDueCallbacks(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(callbacks) != 1 || callbacks[0].ID != "1" || callbacks[0].Attempts != 0 {
+		t.Errorf("Got the pending callbacks %+v, want the hanging one without attempts", callbacks)
+	}
+}
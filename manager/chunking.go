@@ -0,0 +1,159 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"vconvd/lib"
+	"vconvd/model"
+)
+
+const (
+	// every ffprobe run of a new task is limited, so the two of them fit
+	// in the REST request timeout
+	probeTimeout = 4 * time.Second
+	// seconds of the input read around a chunk boundary for its keyframes
+	keyframeWindow = 10.0
+)
+
+// ChunkingPolicy decides how many chunks a video is cut into. Chunks are
+// balanced by the queue, so workers joining later get their share too.
+type ChunkingPolicy struct {
+	TargetDuration time.Duration
+	MinCount       int
+	MaxCount       int
+	// inputs not longer than this are converted as a single chunk
+	BypassDuration time.Duration
+}
+
+// ChunksCount returns the chunks count of a video. With the conversion
+// slots of the cluster known, the count is rounded up to a multiple of
+// them to keep all the slots busy, unless the chunks would get shorter
+// than the bypass duration.
+func (p *ChunkingPolicy) ChunksCount(duration float64, slots int) int {
+	if duration <= p.BypassDuration.Seconds() {
+		return 1
+	}
+
+	count := 1
+	if p.TargetDuration > 0 {
+		count = int(math.Ceil(duration / p.TargetDuration.Seconds()))
+	}
+	if slots > 1 {
+		capacity := int(math.Ceil(float64(count)/float64(slots))) * slots
+		if p.BypassDuration > 0 {
+			if limit := int(duration / p.BypassDuration.Seconds()); capacity > limit {
+				capacity = limit
+			}
+		}
+		if capacity > count {
+			count = capacity
+		}
+	}
+	if p.MinCount > 0 && count < p.MinCount {
+		count = p.MinCount
+	}
+	if p.MaxCount > 0 && count > p.MaxCount {
+		count = p.MaxCount
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	return count
+}
+
+// probeInput probes the input and cuts it into chunks. Only the keyframes
+// around the chunk boundaries are read, so a long input is probed in time.
+func (m *Manager) probeInput(convtask *model.ConversionTask) ([]*model.Chunk, error) {
+	ffmpegh := lib.FFMpegHelper{Timeout: probeTimeout}
+	err := ffmpegh.Parse(convtask.InputFile)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := ffmpegh.GetLength()
+	if err != nil {
+		return nil, err
+	}
+	if duration == 0 {
+		return nil, fmt.Errorf("zero video length")
+	}
+
+	chunksCount := m.chunking.ChunksCount(duration, m.workers.Slots(model.ConversionWorkerKind))
+	targets := boundaryTargets(chunksCount, duration)
+
+	// a single chunk needs no keyframes
+	var keyframes []float64
+	if len(targets) > 0 {
+		window := math.Min(duration/float64(chunksCount)/2, keyframeWindow)
+		keyframes, err = ffmpegh.GetKeyframes(targets, window)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m.getChunks(chunksCount, duration, keyframes), nil
+}
+
+// boundaryTargets returns the times the chunks would be cut at if there
+// were keyframes everywhere.
+func boundaryTargets(chunksCount int, duration float64) []float64 {
+	var targets []float64
+	for i := 1; i < chunksCount; i++ {
+		targets = append(targets, duration*float64(i)/float64(chunksCount))
+	}
+
+	return targets
+}
+
+// getChunks cuts the video into about chunksCount chunks of equal length.
+// Chunks start on keyframes, so they can be split by a stream copy, and
+// tile the whole video without gaps or overlaps. There may be less chunks
+// than requested if keyframes are rare.
+func (m *Manager) getChunks(chunksCount int, duration float64, keyframes []float64) []*model.Chunk {
+	boundaries := []float64{0}
+	for _, target := range boundaryTargets(chunksCount, duration) {
+		boundary := target
+		if len(keyframes) > 0 {
+			boundary = nearestKeyframe(keyframes, target)
+		}
+
+		if boundary <= boundaries[len(boundaries)-1] || boundary >= duration {
+			continue
+		}
+		boundaries = append(boundaries, boundary)
+	}
+	boundaries = append(boundaries, duration)
+
+	var chunks []*model.Chunk
+	for i := 0; i < len(boundaries)-1; i++ {
+		var chunk *model.Chunk = new(model.Chunk)
+		chunk.Sequence = uint32(i) + 1
+		chunk.Offset = boundaries[i]
+		chunk.Length = boundaries[i+1] - boundaries[i]
+		chunk.Status = model.ChunkPendingStatus
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// nearestKeyframe returns the keyframe closest to the given time.
+// keyframes must be sorted.
+func nearestKeyframe(keyframes []float64, t float64) float64 {
+	i := sort.SearchFloat64s(keyframes, t)
+	if i == 0 {
+		return keyframes[0]
+	}
+	if i == len(keyframes) {
+		return keyframes[i-1]
+	}
+
+	if t-keyframes[i-1] <= keyframes[i]-t {
+		return keyframes[i-1]
+	}
+	return keyframes[i]
+}
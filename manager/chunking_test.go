@@ -0,0 +1,126 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"vconvd/model"
+)
+
+func TestChunksCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   ChunkingPolicy
+		duration float64
+		slots    int
+		want     int
+	}{
+		{"target duration", ChunkingPolicy{TargetDuration: time.Minute}, 600, 0, 10},
+		{"partial chunk", ChunkingPolicy{TargetDuration: time.Minute}, 610, 1, 11},
+		{"multiple of the slots", ChunkingPolicy{TargetDuration: time.Minute}, 600, 4, 12},
+		{"slots of a short video", ChunkingPolicy{TargetDuration: time.Minute}, 30, 8, 8},
+		{"bypass", ChunkingPolicy{TargetDuration: time.Minute, BypassDuration: time.Minute}, 60, 8, 1},
+		{"slots limited by the bypass", ChunkingPolicy{TargetDuration: time.Minute, BypassDuration: time.Minute}, 300, 8, 5},
+		{"slots below the target count", ChunkingPolicy{TargetDuration: time.Minute, BypassDuration: 2 * time.Minute}, 600, 4, 10},
+		{"min count", ChunkingPolicy{TargetDuration: time.Minute, MinCount: 3}, 60, 0, 3},
+		{"max count", ChunkingPolicy{TargetDuration: time.Minute, MaxCount: 8}, 600, 4, 8},
+		{"no target", ChunkingPolicy{}, 600, 0, 1},
+		{"no target with slots", ChunkingPolicy{}, 600, 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.ChunksCount(tt.duration, tt.slots); got != tt.want {
+				t.Errorf("ChunksCount(%v, %d) = %d, want %d", tt.duration, tt.slots, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		count     int
+		duration  float64
+		keyframes []float64
+		// offset and length pairs
+		want [][2]float64
+	}{
+		{
+			name:     "no keyframes",
+			count:    4,
+			duration: 10,
+			want:     [][2]float64{{0, 2.5}, {2.5, 2.5}, {5, 2.5}, {7.5, 2.5}},
+		},
+		{
+			name:      "keyframe boundaries",
+			count:     4,
+			duration:  10,
+			keyframes: []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+			want:      [][2]float64{{0, 2}, {2, 3}, {5, 2}, {7, 3}},
+		},
+		{
+			name:      "rare keyframes",
+			count:     4,
+			duration:  10,
+			keyframes: []float64{0, 8},
+			want:      [][2]float64{{0, 8}, {8, 2}},
+		},
+		{
+			name:      "keyframe at the end",
+			count:     2,
+			duration:  10,
+			keyframes: []float64{0, 10},
+			want:      [][2]float64{{0, 10}},
+		},
+		{
+			name:     "single chunk",
+			count:    1,
+			duration: 10,
+			want:     [][2]float64{{0, 10}},
+		},
+	}
+
+	m := &Manager{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := m.getChunks(tt.count, tt.duration, tt.keyframes)
+			if len(chunks) != len(tt.want) {
+				t.Fatalf("got %d chunks, want %d", len(chunks), len(tt.want))
+			}
+
+			for i, chunk := range chunks {
+				if chunk.Sequence != uint32(i+1) || chunk.Status != model.ChunkPendingStatus {
+					t.Errorf("chunk %d: sequence %d, status %s", i, chunk.Sequence, chunk.Status)
+				}
+				if chunk.Offset != tt.want[i][0] || chunk.Length != tt.want[i][1] {
+					t.Errorf("chunk %d: offset %v, length %v, want %v", i, chunk.Offset, chunk.Length, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNearestKeyframe(t *testing.T) {
+	keyframes := []float64{0, 2, 4}
+
+	tests := []struct {
+		t    float64
+		want float64
+	}{
+		{-1, 0},
+		{0, 0},
+		{0.9, 0},
+		{1, 0},
+		{1.1, 2},
+		{2, 2},
+		{3.5, 4},
+		{5, 4},
+	}
+
+	for _, tt := range tests {
+		if got := nearestKeyframe(keyframes, tt.t); got != tt.want {
+			t.Errorf("nearestKeyframe(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
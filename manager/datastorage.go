@@ -2,13 +2,32 @@ package manager
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/boltdb/bolt"
 
 	"vconvd/model"
 )
 
+var (
+	ErrTaskNotFound = errors.New("task not found")
+	ErrTaskFinished = errors.New("task is already finished")
+
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+var buckets = []string{
+	"task",
+	taskCreatedIndex,
+	taskStateIndex,
+	taskProducerIndex,
+	"callback",
+	"dead_letter",
+}
+
 type DataStorage struct {
 	DbFile string
 	_db    *bolt.DB
@@ -29,6 +48,40 @@ func (d *DataStorage) Open() error {
 	}
 
 	d._db = db
+	err = d.migrate()
+	if err != nil {
+		return err
+	}
+
+	return d.countStoredTasks()
+}
+
+// migrate creates the buckets added after the database was created.
+func (d *DataStorage) migrate() error {
+	return d._db.Update(func(tx *bolt.Tx) error {
+		reindex := tx.Bucket([]byte("task")) != nil && tx.Bucket([]byte(taskCreatedIndex)) == nil
+
+		err := createBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		if reindex {
+			log.Infof("Building task indexes")
+			return buildTaskIndexes(tx)
+		}
+		return nil
+	})
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range buckets {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return fmt.Errorf("bucket creation error: %s", err)
+		}
+	}
+
 	return nil
 }
 
@@ -44,13 +97,7 @@ func (d *DataStorage) CreateNewDb() error {
 
 	defer d._db.Close()
 
-	return d._db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte("task"))
-		if err != nil {
-			return fmt.Errorf("bucket creation error: %s", err)
-		}
-		return nil
-	})
+	return d._db.Update(createBuckets)
 }
 
 func (d *DataStorage) CreateTask(task *model.ConversionTask) error {
@@ -59,7 +106,7 @@ func (d *DataStorage) CreateTask(task *model.ConversionTask) error {
 		return err
 	}
 
-	return db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("task"))
 
 		buf, err := json.Marshal(task)
@@ -67,8 +114,97 @@ func (d *DataStorage) CreateTask(task *model.ConversionTask) error {
 			return err
 		}
 
-		return b.Put([]byte(task.ID), buf)
+		err = b.Put([]byte(task.ID), buf)
+		if err != nil {
+			return err
+		}
+
+		return indexTask(tx, nil, task)
+	})
+	if err != nil {
+		return err
+	}
+
+	countTask(task, 1)
+	return nil
+}
+
+func (d *DataStorage) GetTask(id string) (*model.ConversionTask, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+
+	var task model.ConversionTask
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("task"))
+
+		buf := b.Get([]byte(id))
+		if buf == nil {
+			return ErrTaskNotFound
+		}
+
+		return json.Unmarshal(buf, &task)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+// UpdateTask loads the task, applies fn to it and stores the result
+// within a single transaction, so concurrent updates do not overwrite
+// each other.
+func (d *DataStorage) UpdateTask(id string, fn func(task *model.ConversionTask) error) (*model.ConversionTask, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+
+	var old, task model.ConversionTask
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("task"))
+
+		buf := b.Get([]byte(id))
+		if buf == nil {
+			return ErrTaskNotFound
+		}
+
+		old = model.ConversionTask{}
+		err := json.Unmarshal(buf, &old)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(buf, &task)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&task)
+		if err != nil {
+			return err
+		}
+
+		buf, err = json.Marshal(task)
+		if err != nil {
+			return err
+		}
+
+		err = b.Put([]byte(task.ID), buf)
+		if err != nil {
+			return err
+		}
+
+		return indexTask(tx, &old, &task)
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	countTask(&old, -1)
+	countTask(&task, 1)
+	return &task, nil
 }
 
 func (d *DataStorage) DeleteTask(task *model.ConversionTask) error {
@@ -77,8 +213,189 @@ func (d *DataStorage) DeleteTask(task *model.ConversionTask) error {
 		return err
 	}
 
-	return db.Update(func(tx *bolt.Tx) error {
+	var old model.ConversionTask
+	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("task"))
-		return b.Delete([]byte(task.ID))
+
+		buf := b.Get([]byte(task.ID))
+		if buf == nil {
+			return ErrTaskNotFound
+		}
+
+		old = model.ConversionTask{}
+		err := json.Unmarshal(buf, &old)
+		if err != nil {
+			return err
+		}
+
+		err = b.Delete([]byte(task.ID))
+		if err != nil {
+			return err
+		}
+
+		return indexTask(tx, &old, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	countTask(&old, -1)
+	return nil
+}
+
+func (d *DataStorage) CreateCallback(callback *model.Callback) error {
+	db, err := d.db()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("callback"))
+
+		buf, err := json.Marshal(callback)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(callback.ID), buf)
+	})
+}
+
+// GetDueCallbacks returns the pending callbacks which should be delivered
+// by now, the oldest first.
+func (d *DataStorage) GetDueCallbacks(now time.Time) ([]*model.Callback, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+
+	var callbacks []*model.Callback
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("callback"))
+
+		return b.ForEach(func(k, v []byte) error {
+			var callback model.Callback
+			err := json.Unmarshal(v, &callback)
+			if err != nil {
+				return err
+			}
+
+			if !callback.NextAttempt.After(now) {
+				callbacks = append(callbacks, &callback)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(callbacks, func(i, j int) bool {
+		return callbacks[i].CreatedAt.Before(callbacks[j].CreatedAt)
+	})
+
+	return callbacks, nil
+}
+
+func (d *DataStorage) UpdateCallback(callback *model.Callback) error {
+	return d.CreateCallback(callback)
+}
+
+func (d *DataStorage) DeleteCallback(callback *model.Callback) error {
+	db, err := d.db()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("callback"))
+		return b.Delete([]byte(callback.ID))
+	})
+}
+
+func (d *DataStorage) CreateDeadLetter(letter *model.DeadLetter) error {
+	db, err := d.db()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("dead_letter"))
+
+		buf, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(letter.ID), buf)
+	})
+}
+
+func (d *DataStorage) GetDeadLetter(id string) (*model.DeadLetter, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+
+	var letter model.DeadLetter
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("dead_letter"))
+
+		buf := b.Get([]byte(id))
+		if buf == nil {
+			return ErrDeadLetterNotFound
+		}
+
+		return json.Unmarshal(buf, &letter)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &letter, nil
+}
+
+// ListDeadLetters returns all the dead letters, the newest first.
+func (d *DataStorage) ListDeadLetters() ([]*model.DeadLetter, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []*model.DeadLetter{}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("dead_letter"))
+
+		return b.ForEach(func(k, v []byte) error {
+			var letter model.DeadLetter
+			err := json.Unmarshal(v, &letter)
+			if err != nil {
+				return err
+			}
+
+			letters = append(letters, &letter)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].CreatedAt.After(letters[j].CreatedAt)
+	})
+
+	return letters, nil
+}
+
+func (d *DataStorage) DeleteDeadLetter(letter *model.DeadLetter) error {
+	db, err := d.db()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("dead_letter"))
+		return b.Delete([]byte(letter.ID))
 	})
 }
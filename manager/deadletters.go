@@ -0,0 +1,115 @@
+package manager
+
+import (
+	"fmt"
+
+	"vconvd/lib"
+	"vconvd/model"
+)
+
+func (m *Manager) handleDeadLetter(message *lib.Message) error {
+	task, err := model.DecodeTask(message.Body)
+	if err != nil {
+		log.Errorf("Can not unmarshal a dead letter: %s", err)
+		lib.CountMessageError("manager", "")
+		return nil
+	}
+
+	letter, ok := task.Data.(*model.DeadLetter)
+	if !ok {
+		log.Errorf("Unexpected %s message from %s on the dead letter topic", task.Name, task.Sender)
+		return nil
+	}
+
+	log.Warningf("Dead letter %s of the task %s: %s failed %d times: %s",
+		letter.ID, letter.TaskID, letter.Name, letter.Attempts, letter.Error)
+
+	err = m.dataStorage.CreateDeadLetter(letter)
+	if err != nil {
+		log.Errorf("Failed to store the dead letter %s: %s", letter.ID, err)
+		lib.CountMessageError("manager", task.Name)
+		return err
+	}
+
+	return nil
+}
+
+func (m *Manager) ListDeadLetters() ([]*model.DeadLetter, error) {
+	return m.dataStorage.ListDeadLetters()
+}
+
+// ReplayDeadLetter queues the work of the dead letter again. A task failed
+// by the dead letter is resumed, and the rest of its work dropped after the
+// failure is queued again too.
+func (m *Manager) ReplayDeadLetter(id string) (*model.DeadLetter, error) {
+	letter, err := m.dataStorage.GetDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var resumed bool
+	convtask, err := m.dataStorage.UpdateTask(letter.TaskID, func(convtask *model.ConversionTask) error {
+		resumed = false
+
+		switch letter.Name {
+		case "conversion:split", "conversion:convert":
+			chunk := convtask.GetChunk(letter.Sequence)
+			if chunk == nil {
+				return fmt.Errorf("unknown chunk %d", letter.Sequence)
+			}
+
+			status := model.ChunkPendingStatus
+			if letter.Name == "conversion:convert" {
+				status = model.ChunkSplitStatus
+			}
+			chunk.Retry(status)
+
+			if convtask.State == model.TaskFailedState {
+				resumed = convtask.Resume()
+				// the results of the chunks in progress were dropped
+				// while the task was failed, so they are done again
+				for _, chunk := range convtask.Chunks {
+					chunk.Requeue()
+				}
+			} else if convtask.State.IsFinal() {
+				return ErrTaskFinished
+			}
+		case "conversion:join":
+			if convtask.State == model.TaskFailedState {
+				// every chunk is converted, so it goes straight to joining
+				resumed = convtask.Resume() && convtask.Advance(model.TaskJoiningState)
+			} else if convtask.State.IsFinal() {
+				return ErrTaskFinished
+			}
+		case "conversion:thumbnail":
+			if letter.Index < 0 || letter.Index >= len(convtask.Thumbnails) {
+				return fmt.Errorf("unknown thumbnail %d", letter.Index)
+			}
+
+			thumbnail := convtask.Thumbnails[letter.Index]
+			thumbnail.Status, thumbnail.Error = model.ThumbnailPendingStatus, ""
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Replaying the dead letter %s of the task %s", letter.ID, letter.TaskID)
+
+	if resumed {
+		m.dispatchTask(convtask)
+	} else {
+		err = m.Transport.Publish(letter.Topic, letter.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = m.dataStorage.DeleteDeadLetter(letter)
+	if err != nil {
+		log.Errorf("Failed to delete the dead letter %s: %s", letter.ID, err)
+	}
+
+	return letter, nil
+}
@@ -0,0 +1,497 @@
+package manager
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"vconvd/model"
+)
+
+// chunkRun is the worker run of a chunk stage a message reports on.
+type chunkRun struct {
+	// name of the message the run was given out with
+	name     string
+	attempt  int
+	workerID string
+	// owned runs have to be the ones started last, e.g. to finish
+	owned bool
+}
+
+// isCurrent reports whether the run is of the latest attempt given out.
+// A redelivery of the attempt may run along with it, so only the run
+// started last owns the chunk.
+func (r chunkRun) isCurrent(chunk *model.Chunk) bool {
+	attempt := chunk.Attempts
+	if r.name == "conversion:split" {
+		attempt = chunk.SplitAttempts
+	}
+
+	return r.attempt == attempt && (!r.owned || r.workerID == chunk.WorkerID)
+}
+
+// isStale reports whether the run is of an earlier attempt.
+func (r chunkRun) isStale(chunk *model.Chunk) bool {
+	if r.name == "conversion:split" {
+		return r.attempt < chunk.SplitAttempts
+	}
+	return r.attempt < chunk.Attempts
+}
+
+// updateChunk advances the chunk to the given status, calls fn on success
+// and persists the task. It returns false if the transition was refused,
+// e.g. for a duplicated or stale worker message or a finished task.
+func (m *Manager) updateChunk(id string, sequence uint32, status model.ChunkStatus, run chunkRun,
+	fn func(convtask *model.ConversionTask, chunk *model.Chunk)) (*model.ConversionTask, bool, error) {
+
+	run.owned = true
+	return m.changeChunk(id, sequence, status, run, fn)
+}
+
+// startChunk is updateChunk which also accepts a chunk already in the
+// status, as a retried chunk is started again. The run starting the chunk
+// becomes its owner.
+func (m *Manager) startChunk(id string, sequence uint32, status model.ChunkStatus, run chunkRun,
+	fn func(convtask *model.ConversionTask, chunk *model.Chunk)) (*model.ConversionTask, bool, error) {
+
+	run.owned = false
+	return m.changeChunk(id, sequence, status, run, func(convtask *model.ConversionTask, chunk *model.Chunk) {
+		chunk.WorkerID = run.workerID
+		if fn != nil {
+			fn(convtask, chunk)
+		}
+	})
+}
+
+func (m *Manager) changeChunk(id string, sequence uint32, status model.ChunkStatus, run chunkRun,
+	fn func(convtask *model.ConversionTask, chunk *model.Chunk)) (*model.ConversionTask, bool, error) {
+
+	var advanced, stale bool
+	convtask, err := m.dataStorage.UpdateTask(id, func(convtask *model.ConversionTask) error {
+		chunk := convtask.GetChunk(sequence)
+		if chunk == nil {
+			return fmt.Errorf("unknown chunk %d", sequence)
+		}
+
+		advanced, stale = false, run.isStale(chunk)
+		if convtask.State.IsFinal() || !run.isCurrent(chunk) {
+			return nil
+		}
+
+		restart := !run.owned && chunk.Status == status
+		advanced = chunk.Advance(status) || restart
+		if advanced && fn != nil {
+			fn(convtask, chunk)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if advanced {
+		log.Debugf("Chunk %d of the task %s is %s", sequence, id, status)
+	} else {
+		log.Debugf("Ignoring the %s status of the attempt %d by %s for the chunk %d of the task %s",
+			status, run.attempt, run.workerID, sequence, id)
+	}
+
+	// the worker is told to drop the stale attempt it is still running
+	if stale {
+		err = m.revokeQueue(id, sequence, run.name, run.attempt)
+		if err != nil {
+			log.Errorf("Failed to publish the revocation of the chunk %d of the task %s: %s", sequence, id, err)
+		}
+	}
+
+	return convtask, advanced, nil
+}
+
+func (m *Manager) splitStartedTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	started := task.Data.(*model.SplitStartedTask)
+
+	run := chunkRun{name: "conversion:split", attempt: started.Attempt, workerID: started.WorkerID}
+
+	var taskStarted bool
+	convtask, _, err := m.startChunk(started.ID, started.Sequence, model.ChunkSplittingStatus, run,
+		func(convtask *model.ConversionTask, chunk *model.Chunk) {
+			taskStarted = convtask.Advance(model.TaskSplittingState)
+		})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", started.ID, err)
+		return err
+	}
+
+	if taskStarted {
+		m.callbacks.Notify(convtask, model.CallbackBeforeEvent)
+	}
+
+	return nil
+}
+
+func (m *Manager) splitFinishedTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	finished := task.Data.(*model.SplitFinishedTask)
+
+	run := chunkRun{name: "conversion:split", attempt: finished.Attempt, workerID: finished.WorkerID}
+
+	convtask, advanced, err := m.updateChunk(finished.ID, finished.Sequence, model.ChunkSplitStatus, run,
+		func(convtask *model.ConversionTask, chunk *model.Chunk) {
+			chunk.File = finished.ChunkFile
+			chunk.WorkerID = ""
+			// the first conversion is given out
+			chunk.Attempts++
+		})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", finished.ID, err)
+		return err
+	}
+
+	// the redelivery of the finish which has split the chunk is the retry
+	// of its conversion failed to queue
+	chunk := convtask.GetChunk(finished.Sequence)
+	if !advanced && (task.Message.Attempts == 1 || convtask.State.IsFinal() ||
+		chunk.Status != model.ChunkSplitStatus || chunk.File != finished.ChunkFile) {
+		return nil
+	}
+
+	err = m.convertChunk(convtask, chunk)
+	if err != nil {
+		log.Errorf("Can not queue the chunk %d of the task %s for conversion: %s", finished.Sequence, convtask.ID, err)
+		task.Message.Requeue(-1)
+		return err
+	}
+
+	return nil
+}
+
+func (m *Manager) convertChunk(convtask *model.ConversionTask, chunk *model.Chunk) error {
+	convertTask := model.ConvertTask{
+		ID:         convtask.ID,
+		Sequence:   chunk.Sequence,
+		Attempt:    chunk.Attempts,
+		ChunkFile:  chunk.File,
+		OutputExt:  filepath.Ext(convtask.OutputFile),
+		FFMpegArgs: convtask.FFMpegArgs,
+	}
+
+	return m.convertQueue(convtask.ConversionTopic, &convertTask)
+}
+
+func (m *Manager) splitErrorTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	splitError := task.Data.(*model.SplitErrorTask)
+
+	log.Errorf("Failed to split the chunk %d of the task %s: %s",
+		splitError.Sequence, splitError.ID, splitError.Error)
+
+	run := chunkRun{name: "conversion:split", attempt: splitError.Attempt, workerID: splitError.WorkerID}
+
+	var failed bool
+	convtask, _, err := m.updateChunk(splitError.ID, splitError.Sequence, model.ChunkFailedStatus, run,
+		func(convtask *model.ConversionTask, chunk *model.Chunk) {
+			failed = convtask.Fail(fmt.Sprintf("chunk %d split error: %s", chunk.Sequence, splitError.Error))
+		})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", splitError.ID, err)
+		return err
+	}
+
+	if failed {
+		m.callbacks.Notify(convtask, model.CallbackErrorEvent)
+	}
+
+	return nil
+}
+
+func (m *Manager) convStartedTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	started := task.Data.(*model.ConvertStartedTask)
+
+	run := chunkRun{name: "conversion:convert", attempt: started.Attempt, workerID: started.WorkerID}
+
+	_, _, err := m.startChunk(started.ID, started.Sequence, model.ChunkConvertingStatus, run,
+		func(convtask *model.ConversionTask, chunk *model.Chunk) {
+			convtask.Advance(model.TaskConvertingState)
+		})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", started.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *Manager) convFinishedTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	finished := task.Data.(*model.ConvertFinishedTask)
+
+	// the join must be queued only once, so the check is done
+	// within the same transaction as the update
+	run := chunkRun{name: "conversion:convert", attempt: finished.Attempt, workerID: finished.WorkerID}
+
+	var converted bool
+	convtask, advanced, err := m.updateChunk(finished.ID, finished.Sequence, model.ChunkConvertedStatus, run,
+		func(convtask *model.ConversionTask, chunk *model.Chunk) {
+			chunk.ConvertedFile = finished.ChunkFile
+			converted = convtask.IsConverted()
+			if converted {
+				convtask.Advance(model.TaskJoiningState)
+			}
+		})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", finished.ID, err)
+		return err
+	}
+
+	// the redelivery of the finish which has converted the task is the
+	// retry of its join failed to queue
+	if !advanced && task.Message.Attempts > 1 && convtask.State == model.TaskJoiningState {
+		chunk := convtask.GetChunk(finished.Sequence)
+		converted = chunk.Status == model.ChunkConvertedStatus && chunk.ConvertedFile == finished.ChunkFile
+	}
+	if !converted {
+		return nil
+	}
+
+	err = m.joinQueue(convtask)
+	if err != nil {
+		log.Errorf("Can not queue the task %s for joining: %s", convtask.ID, err)
+		task.Message.Requeue(-1)
+		return err
+	}
+
+	return nil
+}
+
+func (m *Manager) convErrorTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	convError := task.Data.(*model.ConvertErrorTask)
+
+	log.Errorf("Worker %s failed to convert the chunk %d of the task %s: %s",
+		convError.WorkerID, convError.Sequence, convError.ID, convError.Error)
+
+	run := chunkRun{name: "conversion:convert", attempt: convError.Attempt, workerID: convError.WorkerID}
+
+	var failed bool
+	convtask, _, err := m.updateChunk(convError.ID, convError.Sequence, model.ChunkFailedStatus, run,
+		func(convtask *model.ConversionTask, chunk *model.Chunk) {
+			failed = convtask.Fail(fmt.Sprintf("chunk %d conversion error: %s", chunk.Sequence, convError.Error))
+		})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", convError.ID, err)
+		return err
+	}
+
+	if failed {
+		m.callbacks.Notify(convtask, model.CallbackErrorEvent)
+	}
+
+	return nil
+}
+
+// reassignChunks puts the chunks the dead worker was splitting or
+// converting back to the queue. A split waiting for its retry stays with
+// its splitter, so it is lost only once the splitter dies.
+func (m *Manager) reassignChunks(workerID string) {
+	for _, state := range []model.TaskState{model.TaskSplittingState, model.TaskConvertingState} {
+		filter := &TaskFilter{State: &state, Limit: maxListLimit}
+		err := m.dataStorage.ForEachTask(filter, func(convtask *model.ConversionTask) error {
+			for _, chunk := range convtask.Chunks {
+				if isLostBy(chunk, workerID) {
+					m.reassignTaskChunks(convtask.ID, workerID)
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Can not list the %s tasks: %s", state, err)
+		}
+	}
+}
+
+// isLostBy reports whether the chunk was in progress on the worker.
+func isLostBy(chunk *model.Chunk, workerID string) bool {
+	inProgress := chunk.Status == model.ChunkSplittingStatus || chunk.Status == model.ChunkConvertingStatus
+	return inProgress && chunk.WorkerID == workerID
+}
+
+// reassignTaskChunks requeues the chunks of the task lost by the dead
+// worker. The task fails once a chunk has been lost too often.
+func (m *Manager) reassignTaskChunks(id string, workerID string) {
+	var reassigned []*model.Chunk
+	var failed bool
+	convtask, err := m.dataStorage.UpdateTask(id, func(convtask *model.ConversionTask) error {
+		reassigned, failed = nil, false
+		if convtask.State.IsFinal() {
+			return nil
+		}
+
+		for _, chunk := range convtask.Chunks {
+			if !isLostBy(chunk, workerID) {
+				continue
+			}
+
+			chunk.Losses++
+			if chunk.Losses >= m.Config.ChunkMaxAttempts {
+				chunk.Advance(model.ChunkFailedStatus)
+				failed = convtask.Fail(fmt.Sprintf("chunk %d was lost by %d dead workers", chunk.Sequence, chunk.Losses))
+				return nil
+			}
+
+			chunk.Requeue()
+			reassigned = append(reassigned, chunk)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", id, err)
+		return
+	}
+
+	if failed {
+		log.Errorf("Task %s failed: %s", id, convtask.Error)
+		m.callbacks.Notify(convtask, model.CallbackErrorEvent)
+		return
+	}
+
+	for _, chunk := range reassigned {
+		log.Infof("Reassigning the chunk %d of the task %s from the dead worker %s, loss %d",
+			chunk.Sequence, id, workerID, chunk.Losses)
+
+		m.requeueChunk(convtask, chunk)
+	}
+}
+
+// requeueChunk gives out the chunk requeued by Chunk.Requeue and revokes
+// its earlier attempt, which may still be running.
+func (m *Manager) requeueChunk(convtask *model.ConversionTask, chunk *model.Chunk) {
+	name, attempt := "conversion:split", chunk.SplitAttempts
+	if chunk.Status == model.ChunkSplitStatus {
+		name, attempt = "conversion:convert", chunk.Attempts
+	}
+
+	err := m.revokeQueue(convtask.ID, chunk.Sequence, name, attempt-1)
+	if err != nil {
+		log.Errorf("Failed to publish the revocation of the chunk %d of the task %s: %s", chunk.Sequence, convtask.ID, err)
+	}
+
+	if chunk.Status == model.ChunkSplitStatus {
+		err = m.convertChunk(convtask, chunk)
+	} else {
+		err = m.splitChunk(convtask, chunk)
+	}
+	if err != nil {
+		log.Errorf("Can not queue the chunk %d of the task %s: %s", chunk.Sequence, convtask.ID, err)
+	}
+}
+
+func (m *Manager) joinFinishedTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	finished := task.Data.(*model.JoinFinishedTask)
+
+	var done bool
+	convtask, err := m.dataStorage.UpdateTask(finished.ID, func(convtask *model.ConversionTask) error {
+		done = convtask.Advance(model.TaskDoneState)
+		if !done {
+			return nil
+		}
+		for _, chunk := range convtask.Chunks {
+			chunk.Advance(model.ChunkJoinedStatus)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", finished.ID, err)
+		return err
+	}
+	if !done {
+		return nil
+	}
+
+	log.Infof("Task %s is done: %s", finished.ID, finished.OutputFile)
+	m.callbacks.Notify(convtask, model.CallbackAfterEvent)
+
+	return nil
+}
+
+func (m *Manager) joinErrorTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	joinError := task.Data.(*model.JoinErrorTask)
+
+	log.Errorf("Failed to join the task %s: %s", joinError.ID, joinError.Error)
+
+	var failed bool
+	convtask, err := m.dataStorage.UpdateTask(joinError.ID, func(convtask *model.ConversionTask) error {
+		failed = convtask.Fail(fmt.Sprintf("join error: %s", joinError.Error))
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", joinError.ID, err)
+		return err
+	}
+
+	if failed {
+		m.callbacks.Notify(convtask, model.CallbackErrorEvent)
+	}
+
+	return nil
+}
+
+func (m *Manager) updateThumbnail(id string, index int, fn func(thumbnail *model.ConversionTaskThumbnail)) error {
+	_, err := m.dataStorage.UpdateTask(id, func(convtask *model.ConversionTask) error {
+		if index < 0 || index >= len(convtask.Thumbnails) {
+			return fmt.Errorf("unknown thumbnail %d", index)
+		}
+
+		fn(convtask.Thumbnails[index])
+		return nil
+	})
+
+	return err
+}
+
+func (m *Manager) thumbnailFinishedTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	finished := task.Data.(*model.ThumbnailFinishedTask)
+
+	err := m.updateThumbnail(finished.ID, finished.Index, func(thumbnail *model.ConversionTaskThumbnail) {
+		thumbnail.Status = model.ThumbnailDoneStatus
+	})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", finished.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *Manager) thumbnailErrorTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	thumbnailError := task.Data.(*model.ThumbnailErrorTask)
+
+	log.Errorf("Failed to make the thumbnail %d of the task %s: %s",
+		thumbnailError.Index, thumbnailError.ID, thumbnailError.Error)
+
+	err := m.updateThumbnail(thumbnailError.ID, thumbnailError.Index, func(thumbnail *model.ConversionTaskThumbnail) {
+		thumbnail.Status = model.ThumbnailFailedStatus
+		thumbnail.Error = thumbnailError.Error
+	})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", thumbnailError.ID, err)
+		return err
+	}
+
+	return nil
+}
@@ -3,14 +3,13 @@ package manager
 import (
 	"errors"
 	"fmt"
-	"math"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/mitchellh/mapstructure"
-	"github.com/nsqio/go-nsq"
-	"github.com/vmihailenco/msgpack"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"vconvd/lib"
 	"vconvd/logger"
@@ -19,27 +18,57 @@ import (
 
 var log = logger.Log
 
+// sender of the manager messages
+const sender = "manager"
+
+// delay of the queued task retried after a failed creation
+const taskRetryDelay = time.Minute * 10
+
+var (
+	ErrWorkerNotFound  = errors.New("worker not found")
+	ErrNoCapableWorker = errors.New("no conversion worker supports the encoders")
+)
+
 type Config struct {
-	NsqdHost            string
-	NsqdPort            int
-	NsqdManagerTopic    string
-	NsqdSplitterTopic   string
-	NsqdConversionTopic string
-	NsqdJoinerTopic     string
-	RestHost            string
-	RestPort            int
-	DbFile              string
+	NsqdHost                string
+	NsqdPort                int
+	NsqdAddresses           []string
+	LookupdHTTPAddresses    []string
+	NsqdManagerTopic        string
+	NsqdSplitterTopic       string
+	NsqdConversionTopic     string
+	NsqdJoinerTopic         string
+	NsqdControlTopic        string
+	NsqdDeadLetterTopic     string
+	RestHost                string
+	RestPort                int
+	DbFile                  string
+	ChunkTargetDuration     time.Duration
+	ChunkMinCount           int
+	ChunkMaxCount           int
+	ChunkBypassDuration     time.Duration
+	CallbackMaxAttempts     int
+	CallbackRetryDelay      time.Duration
+	CallbackMaxDelay        time.Duration
+	CallbackTimeout         time.Duration
+	WorkerHeartbeatInterval time.Duration
+	WorkerHeartbeatTimeout  time.Duration
+	ChunkMaxAttempts        int
 }
 
 type Manager struct {
-	Config      *Config
-	producer    *lib.NsqProducer
-	consumer    *lib.NsqConsumer
-	rest        *Rest
-	dataStorage *DataStorage
-	convworkers map[string]*model.Worker
-
-	doneChan chan bool
+	Config    *Config
+	Transport lib.Transport
+
+	rest             *Rest
+	dataStorage      *DataStorage
+	callbacks        *CallbackNotifier
+	topicsLock       sync.Mutex
+	capabilityTopics map[string]*model.CapabilityTopic
+	chunking         *ChunkingPolicy
+	workers          *WorkerRegistry
+
+	done lib.Done
 }
 
 func New(config *Config) *Manager {
@@ -49,56 +78,85 @@ func New(config *Config) *Manager {
 }
 
 func (m *Manager) Stop() {
-	m.doneChan <- true
+	m.done.Close()
 }
 
 func (m *Manager) Run() {
 	m.dataStorage = &DataStorage{DbFile: m.Config.DbFile}
-	m.convworkers = make(map[string]*model.Worker)
-	m.doneChan = make(chan bool)
+	m.chunking = &ChunkingPolicy{
+		TargetDuration: m.Config.ChunkTargetDuration,
+		MinCount:       m.Config.ChunkMinCount,
+		MaxCount:       m.Config.ChunkMaxCount,
+		BypassDuration: m.Config.ChunkBypassDuration,
+	}
+	m.workers = NewWorkerRegistry(&WorkerRegistryConfig{
+		HeartbeatInterval: m.Config.WorkerHeartbeatInterval,
+		HeartbeatTimeout:  m.Config.WorkerHeartbeatTimeout,
+	})
+	m.workers.OnJoin = m.workerJoined
+	m.workers.OnLeave = m.workerLeft
+	m.capabilityTopics = make(map[string]*model.CapabilityTopic)
 
 	m.ensureDatabase()
 	defer m.dataStorage.Close()
 
-	m.producer = &lib.NsqProducer{
-		Host: m.Config.NsqdHost,
-		Port: m.Config.NsqdPort,
-		Log:  true,
-	}
-	err := m.producer.Setup()
-	if err != nil {
-		log.Fatalf("Can not connect the producer to nsqd at %s:%d",
-			m.Config.NsqdHost, m.Config.NsqdPort)
-	} else {
-		log.Debugf("Producer succesfully connected to nsqd: %s:%d",
-			m.Config.NsqdHost, m.Config.NsqdPort)
-	}
-	defer m.producer.Stop()
+	m.callbacks = NewCallbackNotifier(&CallbackConfig{
+		MaxAttempts: m.Config.CallbackMaxAttempts,
+		RetryDelay:  m.Config.CallbackRetryDelay,
+		MaxDelay:    m.Config.CallbackMaxDelay,
+		Timeout:     m.Config.CallbackTimeout,
+	}, m.dataStorage)
+
+	if m.Transport == nil {
+		transport := &lib.NsqTransport{
+			Host:                 m.Config.NsqdHost,
+			Port:                 m.Config.NsqdPort,
+			Addresses:            m.Config.NsqdAddresses,
+			LookupdHTTPAddresses: m.Config.LookupdHTTPAddresses,
+			Log:                  true,
+		}
+		err := transport.Connect()
+		if err != nil {
+			log.Fatalf("Can not connect the producer to nsqd at %s %s", transport, err)
+		} else {
+			log.Debugf("Producer succesfully connected to nsqd: %s", transport)
+		}
+		defer transport.Stop()
 
-	m.consumer = &lib.NsqConsumer{
-		Host:  m.Config.NsqdHost,
-		Port:  m.Config.NsqdPort,
-		Topic: m.Config.NsqdManagerTopic,
-		Log:   true,
-	}
-	err = m.consumer.Setup()
-	if err != nil {
-		log.Fatalf("Can not setup nsqd consumer: %s", err)
+		m.Transport = transport
 	}
 
-	m.consumer.Nsqc.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
+	m.recoverTasks()
+
+	_, err := m.Transport.Subscribe(&lib.SubscribeConfig{Topic: m.Config.NsqdManagerTopic}, func(message *lib.Message) error {
 		m.handleMessage(message)
 		return nil
-	}))
+	})
+	if err != nil {
+		log.Fatalf("Can not subscribe to the manager topic: %s", err)
+	}
 
-	err = m.consumer.Connect()
+	_, err = m.Transport.Subscribe(&lib.SubscribeConfig{Topic: m.Config.NsqdDeadLetterTopic}, m.handleDeadLetter)
 	if err != nil {
-		log.Fatalf("Can not connect the consumer to nsqd at %s:%d %s", m.Config.NsqdHost, m.Config.NsqdPort, err)
-	} else {
-		log.Debugf("Consumer succesfully connected to nsqd: %s:%d", m.Config.NsqdHost, m.Config.NsqdPort)
+		log.Fatalf("Can not subscribe to the dead letter topic: %s", err)
 	}
 
-	go m.convWorkersGC()
+	collector := &metricsCollector{manager: m}
+	prometheus.MustRegister(collector)
+	defer prometheus.Unregister(collector)
+
+	// the loops use the database, so they are stopped before it is closed
+	var loops sync.WaitGroup
+	defer loops.Wait()
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		m.workers.Run(m.done.C())
+	}()
+	go func() {
+		defer loops.Done()
+		m.callbacks.Run(m.done.C())
+	}()
 
 	m.rest = &Rest{manager: m, config: &RestConfig{
 		RestHost: m.Config.RestHost,
@@ -107,7 +165,7 @@ func (m *Manager) Run() {
 
 	go m.rest.Run()
 
-	<-m.doneChan
+	<-m.done.C()
 	m.rest.StopAndWait()
 }
 
@@ -126,11 +184,11 @@ func (m *Manager) ensureDatabase() {
 	}
 }
 
-func (m *Manager) handleMessage(message *nsq.Message) error {
-	var task model.Task
-	err := msgpack.Unmarshal(message.Body, &task)
+func (m *Manager) handleMessage(message *lib.Message) error {
+	task, err := model.DecodeTask(message.Body)
 	if err != nil {
 		log.Errorf("Can not unmarshal a message: %s", err)
+		lib.CountMessageError("manager", "")
 		message.Finish()
 		return err
 	}
@@ -140,174 +198,323 @@ func (m *Manager) handleMessage(message *nsq.Message) error {
 
 	switch task.Name {
 	case "conversion-worker:register":
-		m.registerConvWorkerTask(&task)
+		err = m.registerWorkerTask(task, model.ConversionWorkerKind)
 	case "conversion-worker:ping":
-		m.pingConvWorkerTask(&task)
+		err = m.pingWorkerTask(task, model.ConversionWorkerKind)
+	case "splitter-worker:register":
+		err = m.registerWorkerTask(task, model.SplitterWorkerKind)
+	case "splitter-worker:ping":
+		err = m.pingWorkerTask(task, model.SplitterWorkerKind)
 	case "conversion:put":
-		m.createTaskTask(&task)
+		err = m.createTaskTask(task)
+	case "splitter-worker:start":
+		err = m.splitStartedTask(task)
+	case "splitter-worker:finish":
+		err = m.splitFinishedTask(task)
+	case "splitter-worker:error":
+		err = m.splitErrorTask(task)
+	case "splitter-worker:progress":
+		err = m.chunkProgressTask(task, model.ChunkSplittingStatus)
+	case "splitter-worker:thumbnail-finish":
+		err = m.thumbnailFinishedTask(task)
+	case "splitter-worker:thumbnail-error":
+		err = m.thumbnailErrorTask(task)
+	case "conversion-worker:start":
+		err = m.convStartedTask(task)
+	case "conversion-worker:finish":
+		err = m.convFinishedTask(task)
+	case "conversion-worker:progress":
+		err = m.chunkProgressTask(task, model.ChunkConvertingStatus)
+	case "conversion-worker:error":
+		err = m.convErrorTask(task)
+	case "joiner-worker:finish":
+		err = m.joinFinishedTask(task)
+	case "joiner-worker:error":
+		err = m.joinErrorTask(task)
+	}
+
+	// the handlers log their errors
+	if err != nil {
+		lib.CountMessageError("manager", task.Name)
 	}
 
 	return nil
 }
 
-func (m *Manager) registerConvWorkerTask(task *model.Task) {
+func (m *Manager) registerWorkerTask(task *model.Task, kind string) error {
 	defer task.Message.Finish()
 
-	var worker model.Worker
-	//TODO: it is not safe. replace this code with someting else
-	mapstructure.Decode(task.Data, &worker)
+	worker := task.Data.(*model.Worker)
+	worker.Kind = kind
 
-	log.Infof("Registering worker %s", worker.ID)
+	log.Infof("Registering %s worker %s at %s", kind, worker.ID, worker.Hostname)
 
-	m.convworkers[worker.ID] = &worker
+	m.workers.Heartbeat(worker)
 
-	rTask := model.Task{Name: "conversion-worker:registered", Data: worker}
-
-	data, err := msgpack.Marshal(rTask)
-	if err != nil {
-		log.Errorf("Failed to marshal a task data to the msgpack format: %s", err)
-		return
-	}
-	err = m.producer.Nsqp.Publish(m.Config.NsqdConversionTopic, data)
+	err := m.workerQueue(worker.ID, workerMessage(kind, "registered"), worker)
 	if err != nil {
 		log.Errorf("Failed to publish task: %s", err)
-		return
+		return err
 	}
+
+	return nil
 }
 
-func (m *Manager) pingConvWorkerTask(task *model.Task) {
-	var worker model.Worker
-	mapstructure.Decode(task.Data, &worker)
-	if _, ok := m.convworkers[worker.ID]; !ok {
-		m.registerConvWorkerTask(task)
+func (m *Manager) pingWorkerTask(task *model.Task, kind string) error {
+	defer task.Message.Finish()
+
+	worker := task.Data.(*model.Worker)
+	worker.Kind = kind
+
+	// pings carry the up to date worker resources
+	if m.workers.Heartbeat(worker) {
+		log.Infof("Registered %s worker %s at %s by its heartbeat", kind, worker.ID, worker.Hostname)
 	}
 
-	m.convworkers[worker.ID].LastPing = time.Now()
-	task.Message.Finish()
+	return nil
+}
+
+// workerMessage returns the name of the message to the worker of the kind.
+func workerMessage(kind string, name string) string {
+	return kind + "-worker:" + name
 }
 
-func (m *Manager) createTaskTask(task *model.Task) {
-	if len(m.convworkers) == 0 {
-		log.Errorf("There is no active workers. Requeue after 5 min.")
-		task.Message.RequeueWithoutBackoff(time.Second * 5)
+// workerJoined is called when a new worker shows up.
+func (m *Manager) workerJoined(worker *model.Worker) {
+	if worker.Kind != model.ConversionWorkerKind {
 		return
 	}
 
-	var convtask model.ConversionTask
-	mapstructure.Decode(task.Data, &convtask)
-	err := m.CreateConvTask(&convtask)
+	// the new worker may be able to serve some of the capability topics
+	err := m.announceTopics()
 	if err != nil {
+		log.Errorf("Failed to announce the conversion topics: %s", err)
+	}
+}
+
+// workerLeft is called when a worker is considered dead.
+func (m *Manager) workerLeft(worker *model.Worker) {
+	log.Infof("Worker %s at %s has left, %d workers remain", worker.ID, worker.Hostname, len(m.workers.List()))
+	m.reassignChunks(worker.ID)
+}
+
+func (m *Manager) createTaskTask(task *model.Task) error {
+	defer task.Message.Finish()
+
+	convtask := task.Data.(*model.ConversionTask)
+	err := m.CreateConvTask(convtask)
+	var retry *retryLaterError
+	if errors.Is(err, ErrNoCapableWorker) {
+		m.rejectConvTask(convtask, err)
+	} else if errors.As(err, &retry) {
+		log.Errorf("Failed to create the task, retrying in %s: %s", taskRetryDelay, err)
+		m.taskQueue(convtask, taskRetryDelay)
+	} else if err != nil {
 		log.Errorf("Failed to create the task: %s", err)
 	}
 
-	task.Message.Finish()
+	return err
+}
+
+// retryLaterError is the error of the task creation which may pass later,
+// e.g. for an input not available yet. The queued tasks are retried on it.
+type retryLaterError struct {
+	err error
+}
+
+func (e *retryLaterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryLaterError) Unwrap() error {
+	return e.err
+}
+
+// rejectConvTask stores the task the cluster can not convert as failed.
+// The producer queueing it has no reply to get the error from, so it is
+// left to the task listing and the error callback.
+func (m *Manager) rejectConvTask(convtask *model.ConversionTask, err error) {
+	log.Errorf("Rejecting the task %s: %s", convtask.ID, err)
+
+	convtask.Fail(err.Error())
+	err = m.dataStorage.CreateTask(convtask)
+	if err != nil {
+		log.Errorf("Failed to create task in the database: %s", err)
+		return
+	}
+
+	m.callbacks.Notify(convtask, model.CallbackErrorEvent)
 }
 
+// CreateConvTask probes the input, stores the task and queues its chunks.
+// The task is cancelled if its chunks can not be queued, otherwise nothing
+// is left behind on error and the caller decides whether to retry.
 func (m *Manager) CreateConvTask(convtask *model.ConversionTask) error {
 	convtask.ID = uuid.New().String()
-	cworkersCount := len(m.convworkers)
+	convtask.State = model.TaskQueuedState
+	convtask.Error = ""
+	convtask.CreatedAt = time.Now()
+	convtask.StartedAt, convtask.FinishedAt = nil, nil
+	for _, thumbnail := range convtask.Thumbnails {
+		thumbnail.Status, thumbnail.Error = model.ThumbnailPendingStatus, ""
+	}
 
-	if cworkersCount == 0 {
-		return m.taskQueue(convtask, time.Second*5)
+	topic, err := m.routeConversion(convtask)
+	if err != nil {
+		return err
 	}
+	convtask.ConversionTopic = topic
 
-	chunksLen, err := m.getChunksLength(convtask)
+	chunks, err := m.probeInput(convtask)
 	if err != nil {
-		m.taskQueue(convtask, time.Minute*10)
-		return fmt.Errorf("Can not probe video file: %s", err)
+		return &retryLaterError{fmt.Errorf("Can not probe video file: %s", err)}
 	}
-	if chunksLen == 0 {
-		m.taskQueue(convtask, time.Minute*10)
-		return fmt.Errorf("Got zero chunks length for some reason")
+	for _, chunk := range chunks {
+		// the first splits are given out
+		chunk.SplitAttempts = 1
 	}
-
-	chunks := m.getChunks(cworkersCount, chunksLen)
 	convtask.Chunks = chunks
 
 	err = m.dataStorage.CreateTask(convtask)
 	if err != nil {
-		m.taskQueue(convtask, time.Minute*10)
-		return fmt.Errorf("Failed to create task in the database: %s", err)
+		return &retryLaterError{fmt.Errorf("Failed to create task in the database: %s", err)}
 	}
 
 	for _, chunk := range convtask.Chunks {
-		splitTask := model.SplitTask{
-			ID:        convtask.ID,
-			InputFile: convtask.InputFile,
-			Chunk:     chunk,
+		err = m.splitChunk(convtask, chunk)
+		if err != nil {
+			// the record is kept for the dead letters of the chunks
+			// queued so far
+			_, cerr := m.CancelConvTask(convtask.ID)
+			if cerr != nil {
+				log.Errorf("Failed to cancel the task %s: %s", convtask.ID, cerr)
+			}
+			return fmt.Errorf("Can not queue a chunk: %s - cancelling the task", err)
 		}
-		err = m.chunkQueue(&splitTask)
+	}
+
+	for i := range convtask.Thumbnails {
+		err = m.makeThumbnail(convtask, i)
 		if err != nil {
-			//TODO: remove the task completly
-			return fmt.Errorf("Can not queue a chunk: %s - removing the task", err)
+			log.Errorf("Can not queue the thumbnail %d of the task %s: %s", i, convtask.ID, err)
 		}
 	}
 
 	return nil
 }
 
-func (m *Manager) removeTask(convtask *model.ConversionTask) {
+func (m *Manager) splitChunk(convtask *model.ConversionTask, chunk *model.Chunk) error {
+	splitTask := model.SplitTask{
+		ID:        convtask.ID,
+		InputFile: convtask.InputFile,
+		Chunk:     chunk,
+		Attempt:   chunk.SplitAttempts,
+	}
 
+	return m.chunkQueue(&splitTask)
 }
 
-func (m *Manager) getChunksLength(convtask *model.ConversionTask) (float64, error) {
-	ffmpegh := lib.FFMpegHelper{}
-	err := ffmpegh.Parse(convtask.InputFile)
-	if err != nil {
-		return 0, err
+func (m *Manager) makeThumbnail(convtask *model.ConversionTask, index int) error {
+	thumbnailTask := model.ThumbnailTask{
+		ID:        convtask.ID,
+		Index:     index,
+		InputFile: convtask.InputFile,
+		Thumbnail: convtask.Thumbnails[index],
+	}
+
+	return m.thumbnailQueue(&thumbnailTask)
+}
+
+// GetWorkers returns the workers of every kind.
+func (m *Manager) GetWorkers() []*model.Worker {
+	return m.workers.List()
+}
+
+// GetConvWorkers returns the conversion workers.
+func (m *Manager) GetConvWorkers() []*model.Worker {
+	workers := []*model.Worker{}
+	for _, worker := range m.workers.List() {
+		if worker.Kind == model.ConversionWorkerKind {
+			workers = append(workers, worker)
+		}
 	}
 
-	videolen, err := ffmpegh.GetLength()
+	return workers
+}
+
+func (m *Manager) GetConvTask(id string) (*model.ConversionTask, error) {
+	return m.dataStorage.GetTask(id)
+}
+
+func (m *Manager) ListConvTasks(filter *TaskFilter) ([]*model.ConversionTask, string, error) {
+	return m.dataStorage.ListTasks(filter)
+}
+
+// CancelConvTask stops the task and tells the workers to kill its ffmpeg
+// processes, drop its queued chunks and remove its chunk files.
+func (m *Manager) CancelConvTask(id string) (*model.ConversionTask, error) {
+	convtask, err := m.dataStorage.UpdateTask(id, func(convtask *model.ConversionTask) error {
+		if !convtask.Advance(model.TaskCancelledState) {
+			return ErrTaskFinished
+		}
+		return nil
+	})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	chunklen := math.Ceil(videolen / float64(len(m.convworkers)))
+	log.Infof("Cancelling the task %s", id)
+
+	err = m.cancelQueue(id)
+	if err != nil {
+		log.Errorf("Failed to publish the cancellation of the task %s: %s", id, err)
+	}
 
-	return chunklen, nil
+	return convtask, nil
 }
 
-func (m *Manager) getChunks(chunksCount int, chunksLen float64) []*model.Chunk {
-	var chunks []*model.Chunk
+// DrainWorker tells the worker to finish its current chunks and stop
+// taking new ones.
+func (m *Manager) DrainWorker(id string) (*model.Worker, error) {
+	worker, ok := m.workers.Get(id)
+	if !ok {
+		return nil, ErrWorkerNotFound
+	}
+
+	log.Infof("Draining the %s worker %s", worker.Kind, id)
 
-	for i := 0; i < chunksCount; i++ {
-		var chunk *model.Chunk = new(model.Chunk)
-		chunk.Sequence = uint32(i) + 1
-		chunk.Offset = float64(i) * chunksLen
-		chunk.Length = chunksLen - 1
-		chunk.Status = model.ChunkPendingStatus
-		chunks = append(chunks, chunk)
+	err := m.workerQueue(id, workerMessage(worker.Kind, "drain"), model.DrainTask{WorkerID: id})
+	if err != nil {
+		return nil, err
 	}
 
-	return chunks
+	return m.workers.SetDraining(id)
 }
 
 func (m *Manager) taskQueue(convtask *model.ConversionTask, delay time.Duration) error {
-	task := model.Task{Name: "conversion:put", Data: convtask}
-	data, err := msgpack.Marshal(task)
+	data, err := model.EncodeTask(sender, "conversion:put", convtask)
 	if err != nil {
 		log.Errorf("Failed to marshal a task data to the msgpack format: %s", err)
 		return fmt.Errorf("Failed to marshal a task data to the msgpack format: %s", err)
 	}
 
-	err = m.producer.Nsqp.DeferredPublish(m.Config.NsqdManagerTopic, delay, data)
+	err = m.Transport.DeferredPublish(m.Config.NsqdManagerTopic, delay, data)
 	if err != nil {
 		log.Errorf("Failed to publish the task %s to the queue: %s", convtask.ID, err)
-	} else {
-		log.Debugf("Pushed to nsqd a new task: %s", convtask.ID)
+		return err
 	}
 
-	return fmt.Errorf("There is no active workers - delayed")
+	log.Debugf("Pushed to nsqd a new task: %s", convtask.ID)
+	return nil
 }
 
 func (m *Manager) chunkQueue(chunk *model.SplitTask) error {
-	task := model.Task{Name: "conversion:split", Data: chunk}
-	data, err := msgpack.Marshal(task)
+	data, err := model.EncodeTask(sender, "conversion:split", chunk)
 	if err != nil {
 		return err
 	}
 
-	err = m.producer.Nsqp.Publish(m.Config.NsqdSplitterTopic, data)
+	err = m.Transport.Publish(m.Config.NsqdSplitterTopic, data)
 	if err != nil {
 		return err
 	}
@@ -315,17 +522,77 @@ func (m *Manager) chunkQueue(chunk *model.SplitTask) error {
 	return nil
 }
 
-func (m *Manager) convWorkersGC() {
-	for true {
-		now := time.Now()
-		for _, worker := range m.convworkers {
-			diff := now.Sub(worker.LastPing)
-			if diff.Seconds() > 10 {
-				log.Debugf("Unregistering worker %s due to last ping time", worker.ID)
-				delete(m.convworkers, worker.ID)
-			}
-		}
+func (m *Manager) thumbnailQueue(thumbnail *model.ThumbnailTask) error {
+	data, err := model.EncodeTask(sender, "conversion:thumbnail", thumbnail)
+	if err != nil {
+		return err
+	}
+
+	return m.Transport.Publish(m.Config.NsqdSplitterTopic, data)
+}
 
-		time.Sleep(time.Second * 5)
+func (m *Manager) convertQueue(topic string, chunk *model.ConvertTask) error {
+	data, err := model.EncodeTask(sender, "conversion:convert", chunk)
+	if err != nil {
+		return err
+	}
+
+	if topic == "" {
+		topic = m.Config.NsqdConversionTopic
+	}
+
+	return m.Transport.Publish(topic, data)
+}
+
+func (m *Manager) joinQueue(convtask *model.ConversionTask) error {
+	chunks := make([]*model.Chunk, len(convtask.Chunks))
+	copy(chunks, convtask.Chunks)
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Sequence < chunks[j].Sequence
+	})
+
+	joinTask := model.JoinTask{ID: convtask.ID, OutputFile: convtask.OutputFile}
+	for _, chunk := range chunks {
+		joinTask.ChunkFiles = append(joinTask.ChunkFiles, chunk.ConvertedFile)
+	}
+
+	data, err := model.EncodeTask(sender, "conversion:join", joinTask)
+	if err != nil {
+		return err
+	}
+
+	return m.Transport.Publish(m.Config.NsqdJoinerTopic, data)
+}
+
+func (m *Manager) cancelQueue(id string) error {
+	data, err := model.EncodeTask(sender, "conversion:cancel", model.CancelTask{ID: id})
+	if err != nil {
+		return err
+	}
+
+	return m.Transport.Publish(m.Config.NsqdControlTopic, data)
+}
+
+func (m *Manager) revokeQueue(id string, sequence uint32, name string, attempt int) error {
+	data, err := model.EncodeTask(sender, "conversion:revoke", model.RevokeTask{
+		ID:       id,
+		Sequence: sequence,
+		Name:     name,
+		Attempt:  attempt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.Transport.Publish(m.Config.NsqdControlTopic, data)
+}
+
+// workerQueue sends the message to the one worker only.
+func (m *Manager) workerQueue(id string, name string, data interface{}) error {
+	buf, err := model.EncodeTask(sender, name, data)
+	if err != nil {
+		return err
 	}
+
+	return m.Transport.Publish(model.WorkerTopic(id), buf)
 }
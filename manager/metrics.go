@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"vconvd/model"
+)
+
+var callbackFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "vconvd",
+	Name:      "callback_failures_total",
+	Help:      "Failed HTTP callback deliveries, retried or given up.",
+}, []string{"result"})
+
+var (
+	tasksGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vconvd",
+		Name:      "tasks",
+		Help:      "Tasks by state.",
+	}, []string{"state"})
+
+	chunksGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vconvd",
+		Name:      "chunks",
+		Help:      "Chunks of the unfinished tasks by status.",
+	}, []string{"status"})
+)
+
+var (
+	workersDesc = prometheus.NewDesc("vconvd_workers",
+		"Registered workers by kind and state.", []string{"kind", "state"}, nil)
+	workerSlotsDesc = prometheus.NewDesc("vconvd_worker_slots",
+		"Slots of the workers taking new chunks by kind.", []string{"kind"}, nil)
+)
+
+// countTask adds the task and the chunks of it unfinished to the gauges,
+// a negative sign removes them. The stored tasks are counted once the
+// database is open and every change of them is counted after its commit.
+func countTask(task *model.ConversionTask, sign float64) {
+	if task == nil {
+		return
+	}
+
+	tasksGauge.WithLabelValues(task.State.String()).Add(sign)
+	if task.State.IsFinal() {
+		return
+	}
+
+	for _, chunk := range task.Chunks {
+		chunksGauge.WithLabelValues(chunk.Status.String()).Add(sign)
+	}
+}
+
+// countStoredTasks sets the gauges to the tasks in the database.
+func (d *DataStorage) countStoredTasks() error {
+	tasks, err := d.CountTasks()
+	if err != nil {
+		return err
+	}
+	for _, state := range model.TaskStates() {
+		tasksGauge.WithLabelValues(state.String()).Set(float64(tasks[state]))
+	}
+
+	chunks := make(map[model.ChunkStatus]int)
+	for _, state := range model.TaskStates() {
+		if state.IsFinal() {
+			continue
+		}
+
+		filter := &TaskFilter{State: &state, Limit: maxListLimit}
+		err = d.ForEachTask(filter, func(convtask *model.ConversionTask) error {
+			for _, chunk := range convtask.Chunks {
+				chunks[chunk.Status]++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, status := range model.ChunkStatuses() {
+		chunksGauge.WithLabelValues(status.String()).Set(float64(chunks[status]))
+	}
+
+	return nil
+}
+
+// metricsCollector reads the worker metrics from the worker registry on
+// every scrape.
+type metricsCollector struct {
+	manager *Manager
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workersDesc
+	ch <- workerSlotsDesc
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	m := c.manager
+
+	type key struct {
+		kind  string
+		state model.WorkerState
+	}
+	workers := make(map[key]int)
+	for _, worker := range m.workers.List() {
+		workers[key{worker.Kind, worker.State}]++
+	}
+
+	for _, kind := range []string{model.SplitterWorkerKind, model.ConversionWorkerKind} {
+		// the dead workers are unregistered
+		for _, state := range []model.WorkerState{model.WorkerHealthyState, model.WorkerSuspectState} {
+			ch <- prometheus.MustNewConstMetric(workersDesc, prometheus.GaugeValue,
+				float64(workers[key{kind, state}]), kind, state.String())
+		}
+
+		ch <- prometheus.MustNewConstMetric(workerSlotsDesc, prometheus.GaugeValue, float64(m.workers.Slots(kind)), kind)
+	}
+}
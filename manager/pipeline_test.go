@@ -0,0 +1,258 @@
+package manager_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"vconvd/conversionworker"
+	"vconvd/joinerworker"
+	"vconvd/lib"
+	"vconvd/manager"
+	"vconvd/model"
+	"vconvd/splitterworker"
+)
+
+// stubFFMpeg stands for ffmpeg: a split writes the seek of the chunk, a
+// conversion copies the chunk and a concat joins the listed files.
+const stubFFMpeg = `#!/bin/sh
+out= in= ss= progress=
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-version) echo "ffmpeg version 0.0-stub"; exit 0 ;;
+	-encoders|-decoders) exit 0 ;;
+	-hide_banner|-nostats|-y) shift ;;
+	-i) in="$2"; shift 2 ;;
+	-ss) ss="$2"; shift 2 ;;
+	-progress) progress=1; shift 2 ;;
+	-*) shift 2 ;;
+	*) out="$1"; shift ;;
+	esac
+done
+
+case "$in" in
+*_concat.txt) sed -n "s/^file '\(.*\)'$/\1/p" "$in" | while read -r f; do cat "$f"; done > "$out" ;;
+*) if [ -n "$ss" ]; then echo "$ss" > "$out"; else cat "$in" > "$out"; fi ;;
+esac
+
+if [ -n "$progress" ]; then
+	printf 'out_time_us=1000000\nspeed=2x\nprogress=end\n'
+fi
+`
+
+// stubFFProbe stands for ffprobe of a 10 seconds video with a keyframe
+// every second.
+const stubFFProbe = `#!/bin/sh
+case "$*" in
+*packet=pts_time,flags*)
+	for t in 0 1 2 3 4 5 6 7 8 9; do echo "$t.000000,K_"; done ;;
+*)
+	echo '{"format": {"duration": "10.000000", "start_time": "0.000000"}, "streams": []}' ;;
+esac
+`
+
+type callback struct {
+	Event string `json:"event"`
+	Task  struct {
+		ID     string `json:"id"`
+		State  string `json:"state"`
+		Error  string `json:"error"`
+		Chunks []struct {
+			Offset float64 `json:"offset"`
+			Status string  `json:"status"`
+		} `json:"chunks"`
+	} `json:"task"`
+}
+
+// TestPipeline runs a task through the manager and the workers over the
+// memory transport, with ffmpeg and ffprobe stubbed out.
+func TestPipeline(t *testing.T) {
+	bin := t.TempDir()
+	for name, script := range map[string]string{"ffmpeg": stubFFMpeg, "ffprobe": stubFFProbe} {
+		err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	chunkPath := filepath.Join(dir, "chunks")
+	err := os.Mkdir(chunkPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, output := filepath.Join(dir, "input.mp4"), filepath.Join(dir, "output.mp4")
+	err = os.WriteFile(input, []byte("video"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callbacks := make(chan callback, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c callback
+		err := json.NewDecoder(r.Body).Decode(&c)
+		if err != nil {
+			t.Errorf("Can not decode the callback: %s", err)
+		}
+		callbacks <- c
+	}))
+	defer server.Close()
+
+	transport := lib.NewMemoryTransport()
+	defer transport.Stop()
+
+	const (
+		managerTopic    = "vconvd-manager"
+		splitterTopic   = "vconvd-splitter"
+		conversionTopic = "vconvd-conversion"
+		joinerTopic     = "vconvd-joiner"
+		controlTopic    = "vconvd-control"
+		deadLetterTopic = "vconvd-dead-letter"
+	)
+
+	m := &manager.Manager{Transport: transport, Config: &manager.Config{
+		NsqdManagerTopic:        managerTopic,
+		NsqdSplitterTopic:       splitterTopic,
+		NsqdConversionTopic:     conversionTopic,
+		NsqdJoinerTopic:         joinerTopic,
+		NsqdControlTopic:        controlTopic,
+		NsqdDeadLetterTopic:     deadLetterTopic,
+		RestHost:                "127.0.0.1",
+		DbFile:                  filepath.Join(dir, "vconvd.db"),
+		ChunkTargetDuration:     3 * time.Second,
+		CallbackMaxAttempts:     3,
+		CallbackRetryDelay:      100 * time.Millisecond,
+		CallbackMaxDelay:        time.Second,
+		CallbackTimeout:         5 * time.Second,
+		WorkerHeartbeatInterval: time.Second,
+		WorkerHeartbeatTimeout:  10 * time.Second,
+		ChunkMaxAttempts:        3,
+	}}
+	splitter := &splitterworker.SplitterWorker{Transport: transport, Config: &splitterworker.Config{
+		NsqdManagerTopic:    managerTopic,
+		NsqdTopic:           splitterTopic,
+		NsqdControlTopic:    controlTopic,
+		NsqdDeadLetterTopic: deadLetterTopic,
+		ChunkPath:           chunkPath,
+		HeartbeatInterval:   time.Second,
+		MaxAttempts:         3,
+		RetryDelay:          100 * time.Millisecond,
+		RetryMaxDelay:       time.Second,
+	}}
+	converter := &conversionworker.ConversionWorker{Transport: transport, Config: &conversionworker.Config{
+		NsqdManagerTopic:    managerTopic,
+		NsqdTopic:           conversionTopic,
+		NsqdControlTopic:    controlTopic,
+		NsqdDeadLetterTopic: deadLetterTopic,
+		ChunkPath:           chunkPath,
+		HeartbeatInterval:   time.Second,
+		MaxAttempts:         3,
+		RetryDelay:          100 * time.Millisecond,
+		RetryMaxDelay:       time.Second,
+		Concurrency:         2,
+	}}
+	joiner := &joinerworker.JoinerWorker{Transport: transport, Config: &joinerworker.Config{
+		NsqdManagerTopic:    managerTopic,
+		NsqdTopic:           joinerTopic,
+		NsqdControlTopic:    controlTopic,
+		NsqdDeadLetterTopic: deadLetterTopic,
+		ChunkPath:           chunkPath,
+		MaxAttempts:         3,
+		RetryDelay:          100 * time.Millisecond,
+		RetryMaxDelay:       time.Second,
+	}}
+
+	var wg sync.WaitGroup
+	for _, run := range []func(){m.Run, splitter.Start, converter.Register, joiner.Start} {
+		wg.Add(1)
+		go func(run func()) {
+			defer wg.Done()
+			run()
+		}(run)
+	}
+	defer func() {
+		m.Stop()
+		splitter.Stop()
+		converter.Stop()
+		joiner.Stop()
+		wg.Wait()
+	}()
+
+	body, err := model.EncodeTask("test", "conversion:put", &model.ConversionTask{
+		InputFile:  input,
+		OutputFile: output,
+		HTTPCallbacks: &model.ConversionTaskHTTPCallbacks{
+			After: server.URL,
+			Error: server.URL,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transport.Publish(managerTopic, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var done callback
+	select {
+	case done = <-callbacks:
+	case <-time.After(30 * time.Second):
+		t.Fatal("The task is not done in time")
+	}
+	if done.Event != model.CallbackAfterEvent || done.Task.State != "done" {
+		t.Fatalf("Got the %s callback of the %s task: %s", done.Event, done.Task.State, done.Task.Error)
+	}
+
+	// 4 chunks of 3 seconds at most, cut on the keyframes nearest to the
+	// quarters of the video
+	wantOffsets := []float64{0, 2, 5, 7}
+	if len(done.Task.Chunks) != len(wantOffsets) {
+		t.Fatalf("Got %d chunks, want %d", len(done.Task.Chunks), len(wantOffsets))
+	}
+	for i, chunk := range done.Task.Chunks {
+		if chunk.Offset != wantOffsets[i] || chunk.Status != "joined" {
+			t.Errorf("Chunk %d is %s at %v, want joined at %v", i, chunk.Status, chunk.Offset, wantOffsets[i])
+		}
+	}
+
+	// every chunk is in the output once and in order
+	joined, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeks := strings.Fields(string(joined))
+	if len(seeks) != len(wantOffsets) {
+		t.Fatalf("Output has %d chunks, want %d: %q", len(seeks), len(wantOffsets), joined)
+	}
+	for i, seek := range seeks {
+		s, err := strconv.ParseFloat(seek, 64)
+		if err != nil || s < wantOffsets[i] || s > wantOffsets[i]+0.01 {
+			t.Errorf("Chunk %d of the output is split at %s, want %v", i, seek, wantOffsets[i])
+		}
+	}
+
+	// the chunks are removed once they are joined
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, err := filepath.Glob(filepath.Join(chunkPath, done.Task.ID+"_*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The chunk files are left: %v", files)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
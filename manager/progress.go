@@ -0,0 +1,62 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+
+	"vconvd/model"
+)
+
+func (m *Manager) chunkProgressTask(task *model.Task, stage model.ChunkStatus) error {
+	defer task.Message.Finish()
+
+	progress := task.Data.(*model.ChunkProgressTask)
+
+	run := chunkRun{name: "conversion:convert", attempt: progress.Attempt, workerID: progress.WorkerID, owned: true}
+	if stage == model.ChunkSplittingStatus {
+		run.name = "conversion:split"
+	}
+
+	// the progress callback is called once per every whole percent
+	var notify bool
+	convtask, err := m.dataStorage.UpdateTask(progress.ID, func(convtask *model.ConversionTask) error {
+		chunk := convtask.GetChunk(progress.Sequence)
+		if chunk == nil {
+			return fmt.Errorf("unknown chunk %d", progress.Sequence)
+		}
+		notify = false
+		if convtask.State.IsFinal() || chunk.Status != stage || !run.isCurrent(chunk) {
+			return nil
+		}
+
+		part := 1.0
+		if chunk.Length > 0 {
+			part = math.Min(progress.OutTime/chunk.Length, 1)
+		}
+
+		switch stage {
+		case model.ChunkSplittingStatus:
+			chunk.SplitProgress = math.Max(chunk.SplitProgress, part)
+		case model.ChunkConvertingStatus:
+			chunk.ConvertProgress = math.Max(chunk.ConvertProgress, part)
+		}
+		chunk.Speed, chunk.FPS = progress.Speed, progress.FPS
+
+		percent := int(convtask.Progress() * 100)
+		if percent > convtask.ProgressNotified {
+			convtask.ProgressNotified = percent
+			notify = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", progress.ID, err)
+		return err
+	}
+
+	if notify {
+		m.callbacks.Notify(convtask, model.CallbackProgressEvent)
+	}
+
+	return nil
+}
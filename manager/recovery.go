@@ -0,0 +1,105 @@
+package manager
+
+import (
+	"vconvd/model"
+)
+
+// recoverTasks picks up the unfinished tasks stored before a restart.
+// The chunks waiting for a worker are given out again under new attempts,
+// which revokes the earlier ones still queued, as the manager may have
+// stopped before queueing them. Over a durable transport the chunks in
+// progress are left to their workers and only watched: they are reassigned
+// once their workers turn out to be dead. Otherwise the queued work is lost
+// with the process and every chunk left is given out again. The pending
+// callbacks are kept in the database and need no recovery.
+func (m *Manager) recoverTasks() {
+	var recovered int
+	for _, state := range []model.TaskState{
+		model.TaskQueuedState,
+		model.TaskSplittingState,
+		model.TaskConvertingState,
+		model.TaskJoiningState,
+	} {
+		filter := &TaskFilter{State: &state, Limit: maxListLimit}
+		err := m.dataStorage.ForEachTask(filter, func(convtask *model.ConversionTask) error {
+			m.recoverTask(convtask)
+			recovered++
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Can not list the %s tasks: %s", state, err)
+		}
+	}
+
+	if recovered > 0 {
+		log.Infof("Recovered %d unfinished tasks", recovered)
+	}
+}
+
+func (m *Manager) recoverTask(convtask *model.ConversionTask) {
+	log.Debugf("Recovering the %s task %s", convtask.State, convtask.ID)
+
+	// the workers have to be told about the capability topics again
+	if convtask.ConversionTopic != "" && convtask.ConversionTopic != m.Config.NsqdConversionTopic {
+		m.addCapabilityTopic(&model.CapabilityTopic{
+			Topic:    convtask.ConversionTopic,
+			Encoders: convtask.Encoders(),
+		})
+	}
+
+	durable := m.Transport.Durable()
+	requeued, err := m.dataStorage.UpdateTask(convtask.ID, func(convtask *model.ConversionTask) error {
+		for _, chunk := range convtask.Chunks {
+			inProgress := chunk.Status == model.ChunkSplittingStatus || chunk.Status == model.ChunkConvertingStatus
+			if durable && inProgress {
+				continue
+			}
+			chunk.Requeue()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Can not update the task %s: %s", convtask.ID, err)
+		return
+	}
+
+	m.dispatchTask(requeued)
+	if !durable {
+		return
+	}
+
+	for _, chunk := range requeued.Chunks {
+		if chunk.Status == model.ChunkSplittingStatus || chunk.Status == model.ChunkConvertingStatus {
+			m.workers.Expect(chunk.WorkerID)
+		}
+	}
+}
+
+// dispatchTask queues the work of the task which is not in progress: the
+// chunks requeued by Chunk.Requeue, the join and the pending thumbnails.
+func (m *Manager) dispatchTask(convtask *model.ConversionTask) {
+	for i, thumbnail := range convtask.Thumbnails {
+		if thumbnail.Status != model.ThumbnailPendingStatus {
+			continue
+		}
+
+		err := m.makeThumbnail(convtask, i)
+		if err != nil {
+			log.Errorf("Can not queue the thumbnail %d of the task %s: %s", i, convtask.ID, err)
+		}
+	}
+
+	if convtask.State == model.TaskJoiningState {
+		err := m.joinQueue(convtask)
+		if err != nil {
+			log.Errorf("Can not queue the task %s for joining: %s", convtask.ID, err)
+		}
+		return
+	}
+
+	for _, chunk := range convtask.Chunks {
+		if chunk.Status == model.ChunkPendingStatus || chunk.Status == model.ChunkSplitStatus {
+			m.requeueChunk(convtask, chunk)
+		}
+	}
+}
@@ -2,14 +2,18 @@ package manager
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 	R "github.com/go-pkgz/rest"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"vconvd/model"
 )
@@ -61,8 +65,15 @@ func (c *Rest) getRouter() chi.Router {
 
 	r.Use(middleware.Timeout(10 * time.Second))
 
+	r.Get("/", c.listTasksAction)
+	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/workers", c.listWorkersAction)
+	r.Post("/workers/{id}/drain", c.drainWorkerAction)
+	r.Get("/dead-letters", c.listDeadLettersAction)
+	r.Post("/dead-letters/{id}/replay", c.replayDeadLetterAction)
 	r.Put("/", c.putTaskAction)
 	r.Get("/{id}", c.getTaskInfoAction)
+	r.Delete("/{id}", c.cancelTaskAction)
 
 	return r
 }
@@ -81,13 +92,240 @@ func (c *Rest) putTaskAction(w http.ResponseWriter, r *http.Request) {
 	err = c.manager.CreateConvTask(&convTask)
 	if err != nil {
 		http.Error(w, string(err.Error()), 400)
+		return
 	}
-	render.JSON(w, r, convTask)
+	render.JSON(w, r, newTaskInfo(&convTask))
 }
 
 func (c *Rest) getTaskInfoAction(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	log.Debugf("Get task info: %s", id)
 
-	render.JSON(w, r, R.JSON{"id": id})
+	convTask, err := c.manager.GetConvTask(id)
+	if errors.Is(err, ErrTaskNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to load the task %s: %s", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	render.JSON(w, r, newTaskInfo(convTask))
+}
+
+func (c *Rest) cancelTaskAction(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	log.Debugf("Cancel task: %s", id)
+
+	convTask, err := c.manager.CancelConvTask(id)
+	if errors.Is(err, ErrTaskNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrTaskFinished) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to cancel the task %s: %s", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	render.JSON(w, r, newTaskInfo(convTask))
+}
+
+func (c *Rest) listTasksAction(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseTaskFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	convTasks, next, err := c.manager.ListConvTasks(filter)
+	if err != nil {
+		log.Errorf("Failed to list tasks: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	tasks := []R.JSON{}
+	for _, convTask := range convTasks {
+		tasks = append(tasks, newTaskInfo(convTask))
+	}
+
+	render.JSON(w, r, R.JSON{"tasks": tasks, "next_cursor": next})
+}
+
+func (c *Rest) listWorkersAction(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, R.JSON{"workers": c.manager.GetWorkers()})
+}
+
+func (c *Rest) drainWorkerAction(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	log.Debugf("Drain worker: %s", id)
+
+	worker, err := c.manager.DrainWorker(id)
+	if errors.Is(err, ErrWorkerNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to drain the worker %s: %s", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	render.JSON(w, r, worker)
+}
+
+func (c *Rest) listDeadLettersAction(w http.ResponseWriter, r *http.Request) {
+	letters, err := c.manager.ListDeadLetters()
+	if err != nil {
+		log.Errorf("Failed to list dead letters: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	items := []R.JSON{}
+	for _, letter := range letters {
+		items = append(items, newDeadLetterInfo(letter))
+	}
+
+	render.JSON(w, r, R.JSON{"dead_letters": items})
+}
+
+func (c *Rest) replayDeadLetterAction(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	log.Debugf("Replay dead letter: %s", id)
+
+	letter, err := c.manager.ReplayDeadLetter(id)
+	if errors.Is(err, ErrDeadLetterNotFound) || errors.Is(err, ErrTaskNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrTaskFinished) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to replay the dead letter %s: %s", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	render.JSON(w, r, newDeadLetterInfo(letter))
+}
+
+func parseTaskFilter(r *http.Request) (*TaskFilter, error) {
+	query := r.URL.Query()
+	filter := &TaskFilter{
+		ProducerID: query.Get("producer_id"),
+		Cursor:     query.Get("cursor"),
+	}
+
+	if v := query.Get("state"); v != "" {
+		state, err := model.ParseTaskState(v)
+		if err != nil {
+			return nil, err
+		}
+		filter.State = &state
+	}
+
+	if v := query.Get("created_after"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid created_after: %s", err)
+		}
+		filter.CreatedAfter = t
+	}
+
+	if v := query.Get("created_before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid created_before: %s", err)
+		}
+		filter.CreatedBefore = t
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit: %s", err)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+func newTaskInfo(convTask *model.ConversionTask) R.JSON {
+	chunks := []R.JSON{}
+	for _, chunk := range convTask.Chunks {
+		chunks = append(chunks, R.JSON{
+			"sequence":       chunk.Sequence,
+			"offset":         chunk.Offset,
+			"length":         chunk.Length,
+			"status":         chunk.Status.String(),
+			"progress":       percent(chunk.Progress()),
+			"speed":          chunk.Speed,
+			"fps":            chunk.FPS,
+			"worker_id":      chunk.WorkerID,
+			"attempts":       chunk.Attempts,
+			"split_attempts": chunk.SplitAttempts,
+			"losses":         chunk.Losses,
+		})
+	}
+
+	thumbnails := []R.JSON{}
+	for _, thumbnail := range convTask.Thumbnails {
+		thumbnails = append(thumbnails, R.JSON{
+			"seek":        thumbnail.Seek,
+			"size":        thumbnail.Size,
+			"output_file": thumbnail.OutputFile,
+			"status":      thumbnail.Status.String(),
+			"error":       thumbnail.Error,
+		})
+	}
+
+	var eta interface{}
+	if d, ok := convTask.ETA(); ok {
+		eta = math.Round(d.Seconds())
+	}
+
+	return R.JSON{
+		"id":          convTask.ID,
+		"producer_id": convTask.ProducerID,
+		"state":       convTask.State.String(),
+		"input_file":  convTask.InputFile,
+		"output_file": convTask.OutputFile,
+		"error":       convTask.Error,
+		"progress":    percent(convTask.Progress()),
+		"eta":         eta,
+		"created_at":  convTask.CreatedAt,
+		"started_at":  convTask.StartedAt,
+		"finished_at": convTask.FinishedAt,
+		"chunks":      chunks,
+		"thumbnails":  thumbnails,
+	}
+}
+
+func newDeadLetterInfo(letter *model.DeadLetter) R.JSON {
+	return R.JSON{
+		"id":         letter.ID,
+		"topic":      letter.Topic,
+		"name":       letter.Name,
+		"task_id":    letter.TaskID,
+		"sequence":   letter.Sequence,
+		"index":      letter.Index,
+		"attempts":   letter.Attempts,
+		"error":      letter.Error,
+		"created_at": letter.CreatedAt,
+	}
+}
+
+func percent(part float64) float64 {
+	return math.Round(part*1000) / 10
 }
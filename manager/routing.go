@@ -0,0 +1,96 @@
+package manager
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"vconvd/model"
+)
+
+// nsqd limits topic names to 64 characters
+const maxTopicLength = 64
+
+// capabilityTopic returns the conversion topic for the tasks requiring the
+// given encoders. Only workers having all of them subscribe to it.
+func (m *Manager) capabilityTopic(encoders []string) string {
+	topic := m.Config.NsqdConversionTopic + "." + strings.Join(encoders, ".")
+	if len(topic) <= maxTopicLength {
+		return topic
+	}
+
+	hash := sha1.Sum([]byte(strings.Join(encoders, ",")))
+	return m.Config.NsqdConversionTopic + "." + hex.EncodeToString(hash[:8])
+}
+
+// routeConversion picks the conversion topic of the task. Tasks without
+// specific encoders go to the shared topic. If workers are registered but
+// none of the ones still taking chunks has the requested encoders, the
+// task is rejected. With no workers at all it is routed anyway and waits
+// for the capable workers to come.
+func (m *Manager) routeConversion(convtask *model.ConversionTask) (string, error) {
+	encoders := convtask.Encoders()
+	if len(encoders) == 0 {
+		return m.Config.NsqdConversionTopic, nil
+	}
+
+	workers := m.GetConvWorkers()
+	capable := len(workers) == 0
+	for _, worker := range workers {
+		if !worker.Draining && worker.CanEncode(encoders) {
+			capable = true
+			break
+		}
+	}
+	if !capable {
+		return "", fmt.Errorf("%w: %s", ErrNoCapableWorker, strings.Join(encoders, ", "))
+	}
+
+	topic := &model.CapabilityTopic{
+		Topic:    m.capabilityTopic(encoders),
+		Encoders: encoders,
+	}
+
+	if m.addCapabilityTopic(topic) {
+		err := m.announceTopics()
+		if err != nil {
+			log.Errorf("Failed to announce the conversion topic %s: %s", topic.Topic, err)
+		}
+	}
+
+	return topic.Topic, nil
+}
+
+// addCapabilityTopic remembers the topic and reports whether it is new.
+func (m *Manager) addCapabilityTopic(topic *model.CapabilityTopic) bool {
+	m.topicsLock.Lock()
+	defer m.topicsLock.Unlock()
+
+	_, known := m.capabilityTopics[topic.Topic]
+	m.capabilityTopics[topic.Topic] = topic
+	return !known
+}
+
+// announceTopics tells the conversion workers about the capability topics,
+// so every capable worker subscribes to them.
+func (m *Manager) announceTopics() error {
+	subscribeTask := model.SubscribeTask{}
+
+	m.topicsLock.Lock()
+	for _, topic := range m.capabilityTopics {
+		subscribeTask.Topics = append(subscribeTask.Topics, topic)
+	}
+	m.topicsLock.Unlock()
+
+	if len(subscribeTask.Topics) == 0 {
+		return nil
+	}
+
+	data, err := model.EncodeTask(sender, "conversion-worker:subscribe", subscribeTask)
+	if err != nil {
+		return err
+	}
+
+	return m.Transport.Publish(m.Config.NsqdControlTopic, data)
+}
@@ -0,0 +1,275 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"vconvd/model"
+)
+
+// Secondary indexes of the task bucket. Every index key is the creation
+// time of a task followed by its id, so tasks are ordered by creation time
+// in all of them. The state and producer indexes have a nested bucket per
+// state and per producer.
+const (
+	taskCreatedIndex  = "task_created"
+	taskStateIndex    = "task_state"
+	taskProducerIndex = "task_producer"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+type TaskFilter struct {
+	State         *model.TaskState
+	ProducerID    string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Cursor        string
+	Limit         int
+}
+
+func taskIndexKey(task *model.ConversionTask) []byte {
+	return append(timeIndexKey(task.CreatedAt), []byte(task.ID)...)
+}
+
+func timeIndexKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func stateIndexBucket(state model.TaskState) []byte {
+	return []byte(state.String())
+}
+
+// indexTask moves the task from the old index entries to the new ones.
+// old is nil for a new task and task is nil for a deleted one.
+func indexTask(tx *bolt.Tx, old *model.ConversionTask, task *model.ConversionTask) error {
+	created := tx.Bucket([]byte(taskCreatedIndex))
+	states := tx.Bucket([]byte(taskStateIndex))
+	producers := tx.Bucket([]byte(taskProducerIndex))
+
+	if old != nil {
+		key := taskIndexKey(old)
+
+		err := created.Delete(key)
+		if err != nil {
+			return err
+		}
+
+		if b := states.Bucket(stateIndexBucket(old.State)); b != nil {
+			err = b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		if old.ProducerID != "" {
+			if b := producers.Bucket([]byte(old.ProducerID)); b != nil {
+				err = b.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if task == nil {
+		return nil
+	}
+
+	key := taskIndexKey(task)
+
+	err := created.Put(key, []byte(task.ID))
+	if err != nil {
+		return err
+	}
+
+	b, err := states.CreateBucketIfNotExists(stateIndexBucket(task.State))
+	if err != nil {
+		return err
+	}
+	err = b.Put(key, []byte(task.ID))
+	if err != nil {
+		return err
+	}
+
+	if task.ProducerID != "" {
+		b, err = producers.CreateBucketIfNotExists([]byte(task.ProducerID))
+		if err != nil {
+			return err
+		}
+		err = b.Put(key, []byte(task.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func buildTaskIndexes(tx *bolt.Tx) error {
+	return tx.Bucket([]byte("task")).ForEach(func(k, v []byte) error {
+		var task model.ConversionTask
+		err := json.Unmarshal(v, &task)
+		if err != nil {
+			return err
+		}
+
+		return indexTask(tx, nil, &task)
+	})
+}
+
+// ForEachTask calls fn for all the tasks matching the filter, page by page.
+func (d *DataStorage) ForEachTask(filter *TaskFilter, fn func(task *model.ConversionTask) error) error {
+	page := *filter
+	for {
+		tasks, next, err := d.ListTasks(&page)
+		if err != nil {
+			return err
+		}
+
+		for _, task := range tasks {
+			err = fn(task)
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		page.Cursor = next
+	}
+}
+
+// CountTasks returns the number of the tasks in every state.
+func (d *DataStorage) CountTasks() (map[model.TaskState]int, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[model.TaskState]int)
+	err = db.View(func(tx *bolt.Tx) error {
+		states := tx.Bucket([]byte(taskStateIndex))
+		for _, state := range model.TaskStates() {
+			if b := states.Bucket(stateIndexBucket(state)); b != nil {
+				counts[state] = b.Stats().KeyN
+			}
+		}
+		return nil
+	})
+
+	return counts, err
+}
+
+// ListTasks returns the tasks matching the filter, newest first, and the
+// cursor of the next page. The cursor is empty on the last page.
+func (d *DataStorage) ListTasks(filter *TaskFilter) ([]*model.ConversionTask, string, error) {
+	db, err := d.db()
+	if err != nil {
+		return nil, "", err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	var upper, lower []byte
+	if filter.Cursor != "" {
+		upper, err = hex.DecodeString(filter.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %s", err)
+		}
+	}
+	if !filter.CreatedBefore.IsZero() {
+		before := timeIndexKey(filter.CreatedBefore)
+		if upper == nil || bytes.Compare(before, upper) < 0 {
+			upper = before
+		}
+	}
+	if !filter.CreatedAfter.IsZero() {
+		lower = timeIndexKey(filter.CreatedAfter.Add(time.Nanosecond))
+	}
+
+	var tasks []*model.ConversionTask
+	var next string
+	err = db.View(func(tx *bolt.Tx) error {
+		// use the most selective index we have
+		var index *bolt.Bucket
+		switch {
+		case filter.State != nil:
+			index = tx.Bucket([]byte(taskStateIndex)).Bucket(stateIndexBucket(*filter.State))
+		case filter.ProducerID != "":
+			index = tx.Bucket([]byte(taskProducerIndex)).Bucket([]byte(filter.ProducerID))
+		default:
+			index = tx.Bucket([]byte(taskCreatedIndex))
+		}
+		if index == nil {
+			return nil
+		}
+
+		b := tx.Bucket([]byte("task"))
+		c := index.Cursor()
+
+		var k, v []byte
+		if upper == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Seek(upper)
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			if lower != nil && bytes.Compare(k, lower) < 0 {
+				break
+			}
+
+			buf := b.Get(v)
+			if buf == nil {
+				continue
+			}
+
+			var task model.ConversionTask
+			err := json.Unmarshal(buf, &task)
+			if err != nil {
+				return err
+			}
+
+			if filter.ProducerID != "" && task.ProducerID != filter.ProducerID {
+				continue
+			}
+
+			tasks = append(tasks, &task)
+			if len(tasks) == limit {
+				next = hex.EncodeToString(k)
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return tasks, next, nil
+}
@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"vconvd/model"
+)
+
+func openTestStorage(t *testing.T) *DataStorage {
+	t.Helper()
+
+	d := &DataStorage{DbFile: filepath.Join(t.TempDir(), "vconvd.db")}
+	err := d.CreateNewDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+
+	return d
+}
+
+func TestListTasksPaging(t *testing.T) {
+	d := openTestStorage(t)
+
+	// task-4 is the newest, odd tasks are done
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		state := model.TaskQueuedState
+		if i%2 == 1 {
+			state = model.TaskDoneState
+		}
+
+		err := d.CreateTask(&model.ConversionTask{
+			ID:         fmt.Sprintf("task-%d", i),
+			ProducerID: "producer",
+			State:      state,
+			CreatedAt:  created.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := model.TaskDoneState
+	tests := []struct {
+		name   string
+		filter TaskFilter
+		want   [][]string
+	}{
+		{
+			name:   "pages",
+			filter: TaskFilter{Limit: 2},
+			want:   [][]string{{"task-4", "task-3"}, {"task-2", "task-1"}, {"task-0"}},
+		},
+		{
+			name:   "single page",
+			filter: TaskFilter{Limit: 10},
+			want:   [][]string{{"task-4", "task-3", "task-2", "task-1", "task-0"}},
+		},
+		{
+			name:   "state",
+			filter: TaskFilter{State: &done, Limit: 1},
+			want:   [][]string{{"task-3"}, {"task-1"}, nil},
+		},
+		{
+			name:   "producer",
+			filter: TaskFilter{ProducerID: "producer", Limit: 3},
+			want:   [][]string{{"task-4", "task-3", "task-2"}, {"task-1", "task-0"}},
+		},
+		{
+			name:   "created range",
+			filter: TaskFilter{CreatedAfter: created, CreatedBefore: created.Add(4 * time.Minute), Limit: 2},
+			want:   [][]string{{"task-3", "task-2"}, {"task-1"}},
+		},
+		{
+			name:   "unknown producer",
+			filter: TaskFilter{ProducerID: "nobody"},
+			want:   [][]string{nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := tt.filter
+
+			var pages [][]string
+			for {
+				tasks, next, err := d.ListTasks(&filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var ids []string
+				for _, task := range tasks {
+					ids = append(ids, task.ID)
+				}
+				pages = append(pages, ids)
+
+				if next == "" || len(pages) > len(tt.want) {
+					break
+				}
+				filter.Cursor = next
+			}
+
+			if !reflect.DeepEqual(pages, tt.want) {
+				t.Errorf("got pages %v, want %v", pages, tt.want)
+			}
+		})
+	}
+}
+
+func TestListTasksInvalidCursor(t *testing.T) {
+	d := openTestStorage(t)
+
+	_, _, err := d.ListTasks(&TaskFilter{Cursor: "not hex"})
+	if err == nil {
+		t.Fatal("an invalid cursor is accepted")
+	}
+}
@@ -0,0 +1,195 @@
+package manager
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"vconvd/model"
+)
+
+type WorkerRegistryConfig struct {
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+}
+
+// WorkerRegistry keeps the workers of every kind and their health. A worker
+// becomes suspect once it misses a heartbeat and dead once it misses them
+// for longer than the timeout; dead workers are removed.
+type WorkerRegistry struct {
+	config  *WorkerRegistryConfig
+	mu      sync.Mutex
+	workers map[string]*model.Worker
+	// workers known from the stored tasks only, e.g. after a restart
+	expected map[string]time.Time
+
+	// OnJoin and OnLeave are called outside of the lock when a worker
+	// registers and when it dies.
+	OnJoin  func(worker *model.Worker)
+	OnLeave func(worker *model.Worker)
+}
+
+func NewWorkerRegistry(config *WorkerRegistryConfig) *WorkerRegistry {
+	return &WorkerRegistry{
+		config:   config,
+		workers:  make(map[string]*model.Worker),
+		expected: make(map[string]time.Time),
+	}
+}
+
+// Heartbeat stores the up to date worker data, registering the worker if
+// it is new. It reports whether the worker has just joined.
+func (r *WorkerRegistry) Heartbeat(worker *model.Worker) bool {
+	r.mu.Lock()
+	old, known := r.workers[worker.ID]
+	delete(r.expected, worker.ID)
+
+	stored := *worker
+	stored.LastPing = time.Now()
+	stored.State = model.WorkerHealthyState
+	if known && old.Draining {
+		stored.Draining = true
+	}
+	r.workers[worker.ID] = &stored
+	joined := stored
+	r.mu.Unlock()
+
+	if known && old.State != model.WorkerHealthyState {
+		log.Infof("Worker %s is healthy again", worker.ID)
+	}
+
+	if !known && r.OnJoin != nil {
+		r.OnJoin(&joined)
+	}
+
+	return !known
+}
+
+// Expect waits for a heartbeat of the worker which is not registered yet.
+// If it does not come within the timeout, the worker leaves as a dead one.
+func (r *WorkerRegistry) Expect(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.workers[id]; ok {
+		return
+	}
+	if _, ok := r.expected[id]; !ok {
+		r.expected[id] = time.Now()
+	}
+}
+
+func (r *WorkerRegistry) Get(id string) (*model.Worker, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	worker, ok := r.workers[id]
+	if !ok {
+		return nil, false
+	}
+
+	copied := *worker
+	return &copied, true
+}
+
+// List returns a copy of the workers sorted by id.
+func (r *WorkerRegistry) List() []*model.Worker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	workers := []*model.Worker{}
+	for _, worker := range r.workers {
+		copied := *worker
+		workers = append(workers, &copied)
+	}
+
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].ID < workers[j].ID
+	})
+
+	return workers
+}
+
+// Slots returns the slots of the workers of the kind which take new chunks.
+func (r *WorkerRegistry) Slots(kind string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var slots int
+	for _, worker := range r.workers {
+		if worker.Kind != kind || worker.Draining || worker.State != model.WorkerHealthyState {
+			continue
+		}
+
+		if worker.Slots > 0 {
+			slots += worker.Slots
+		} else {
+			slots++
+		}
+	}
+
+	return slots
+}
+
+func (r *WorkerRegistry) SetDraining(id string) (*model.Worker, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	worker, ok := r.workers[id]
+	if !ok {
+		return nil, ErrWorkerNotFound
+	}
+
+	worker.Draining = true
+	copied := *worker
+	return &copied, nil
+}
+
+// check updates the health of the workers at the given time.
+func (r *WorkerRegistry) check(now time.Time) {
+	var dead []*model.Worker
+
+	r.mu.Lock()
+	for id, worker := range r.workers {
+		silence := now.Sub(worker.LastPing)
+
+		switch {
+		case silence > r.config.HeartbeatTimeout:
+			log.Infof("Unregistering worker %s, no heartbeat for %s", id, silence.Round(time.Second))
+			worker.State = model.WorkerDeadState
+			delete(r.workers, id)
+			dead = append(dead, worker)
+		case silence > r.config.HeartbeatInterval*2 && worker.State == model.WorkerHealthyState:
+			log.Warningf("Worker %s missed a heartbeat", id)
+			worker.State = model.WorkerSuspectState
+		}
+	}
+
+	for id, since := range r.expected {
+		if now.Sub(since) > r.config.HeartbeatTimeout {
+			log.Infof("Worker %s has not shown up for %s", id, now.Sub(since).Round(time.Second))
+			delete(r.expected, id)
+			dead = append(dead, &model.Worker{ID: id, State: model.WorkerDeadState})
+		}
+	}
+	r.mu.Unlock()
+
+	if r.OnLeave != nil {
+		for _, worker := range dead {
+			r.OnLeave(worker)
+		}
+	}
+}
+
+// Run checks the workers until done is closed.
+func (r *WorkerRegistry) Run(done <-chan struct{}) {
+	for {
+		r.check(time.Now())
+
+		select {
+		case <-done:
+			return
+		case <-time.After(r.config.HeartbeatInterval / 2):
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	CallbackBeforeEvent   = "before"
+	CallbackAfterEvent    = "after"
+	CallbackErrorEvent    = "error"
+	CallbackProgressEvent = "progress"
+)
+
+// Callback is a pending delivery of a task event to one of the
+// ConversionTaskHTTPCallbacks URLs.
+type Callback struct {
+	ID          string          `json:"id"`
+	TaskID      string          `json:"task_id"`
+	Event       string          `json:"event"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+func (c *ConversionTaskHTTPCallbacks) URL(event string) string {
+	switch event {
+	case CallbackBeforeEvent:
+		return c.Before
+	case CallbackAfterEvent:
+		return c.After
+	case CallbackErrorEvent:
+		return c.Error
+	case CallbackProgressEvent:
+		return c.Progress
+	}
+
+	return ""
+}
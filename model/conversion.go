@@ -1,14 +1,89 @@
 package model
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/nsqio/go-nsq"
+	"vconvd/lib"
+)
+
+// the kinds of the workers reporting to the manager, the names of their
+// messages start with the kind
+const (
+	ConversionWorkerKind = "conversion"
+	SplitterWorkerKind   = "splitter"
 )
 
 type Worker struct {
-	ID       string
-	LastPing time.Time
+	ID string `json:"id"`
+	// Kind is set by the manager from the messages of the worker
+	Kind          string    `json:"kind"`
+	LastPing      time.Time `json:"last_ping"`
+	Hostname      string    `json:"hostname"`
+	CPUCount      int       `json:"cpu_count"`
+	FreeMemory    uint64    `json:"free_memory"`
+	FreeDisk      uint64    `json:"free_disk"`
+	FFMpegVersion string    `json:"ffmpeg_version"`
+	Encoders      []string  `json:"encoders"`
+	Decoders      []string  `json:"decoders"`
+	// Slots is the count of chunks processed at once
+	Slots    int         `json:"slots"`
+	Draining bool        `json:"draining"`
+	State    WorkerState `json:"state"`
+}
+
+// WorkerState is the health of a worker as seen by the manager.
+type WorkerState uint8
+
+const (
+	WorkerHealthyState WorkerState = iota
+	// the worker has missed a heartbeat
+	WorkerSuspectState
+	// the worker has missed heartbeats for longer than the timeout
+	WorkerDeadState
+)
+
+var workerStateNames = map[WorkerState]string{
+	WorkerHealthyState: "healthy",
+	WorkerSuspectState: "suspect",
+	WorkerDeadState:    "dead",
+}
+
+func (s WorkerState) String() string {
+	if name, ok := workerStateNames[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+func (s WorkerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// WorkerTopic returns the topic the worker gets the messages addressed
+// only to it on. It is ephemeral, so nsqd drops it with the worker.
+func WorkerTopic(id string) string {
+	return "vconvd-worker." + id + "#ephemeral"
+}
+
+// CanEncode reports whether the worker ffmpeg has all the encoders.
+func (w *Worker) CanEncode(encoders []string) bool {
+	available := map[string]bool{}
+	for _, encoder := range w.Encoders {
+		available[encoder] = true
+	}
+
+	for _, encoder := range encoders {
+		if !available[encoder] {
+			return false
+		}
+	}
+
+	return true
 }
 
 type TaskError struct {
@@ -16,10 +91,17 @@ type TaskError struct {
 	message string
 }
 
+// Task is the envelope of all the messages, see EncodeTask and DecodeTask.
+// Data is the decoded payload, a pointer to the type of the message name.
 type Task struct {
-	Message *nsq.Message
-	Name    string      `json:"name"`
-	Data    interface{} `json:"data"`
+	Message   *lib.Message `msgpack:"-" json:"-"`
+	Version   uint16       `json:"version"`
+	ID        string       `json:"id"`
+	Timestamp time.Time    `json:"timestamp"`
+	Sender    string       `json:"sender"`
+	Name      string       `json:"name"`
+	Payload   []byte       `json:"payload"`
+	Data      interface{}  `msgpack:"-" json:"data"`
 }
 
 type ConversionTask struct {
@@ -30,43 +112,534 @@ type ConversionTask struct {
 	FFMpegArgs    map[string]string            `json:"ffmpeg_args"`
 	Thumbnails    []*ConversionTaskThumbnail   `json:"thumbnails"`
 	HTTPCallbacks *ConversionTaskHTTPCallbacks `json:"callbacks"`
-	Chunks        []*Chunk                     `json:"chunks"`
+	// the topic of the conversion workers able to encode the task
+	ConversionTopic string     `json:"conversion_topic"`
+	Chunks          []*Chunk   `json:"chunks"`
+	State           TaskState  `json:"state"`
+	Error           string     `json:"error"`
+	CreatedAt       time.Time  `json:"created_at"`
+	StartedAt       *time.Time `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at"`
+	// the last task percent sent to the progress callback
+	ProgressNotified int `json:"progress_notified"`
 }
 
+type TaskState uint8
+
 const (
-	ChunkPendingStatus = iota
-	ChunkWorkingStatus = iota
+	TaskQueuedState TaskState = iota
+	TaskSplittingState
+	TaskConvertingState
+	TaskJoiningState
+	TaskDoneState
+	TaskFailedState
+	TaskCancelledState
 )
 
+var taskStateNames = map[TaskState]string{
+	TaskQueuedState:     "queued",
+	TaskSplittingState:  "splitting",
+	TaskConvertingState: "converting",
+	TaskJoiningState:    "joining",
+	TaskDoneState:       "done",
+	TaskFailedState:     "failed",
+	TaskCancelledState:  "cancelled",
+}
+
+func (s TaskState) String() string {
+	if name, ok := taskStateNames[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// TaskStates returns all the task states.
+func TaskStates() []TaskState {
+	var states []TaskState
+	for state := TaskQueuedState; state <= TaskCancelledState; state++ {
+		states = append(states, state)
+	}
+	return states
+}
+
+func ParseTaskState(name string) (TaskState, error) {
+	for state, stateName := range taskStateNames {
+		if stateName == name {
+			return state, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown task state: %s", name)
+}
+
+// IsFinal reports whether the task can not change its state anymore.
+func (s TaskState) IsFinal() bool {
+	return s == TaskDoneState || s == TaskFailedState || s == TaskCancelledState
+}
+
+// Advance moves the task forward to the given state and keeps the start
+// and finish timestamps. Like Chunk.Advance it never goes backwards.
+func (t *ConversionTask) Advance(state TaskState) bool {
+	if t.State.IsFinal() || state <= t.State {
+		return false
+	}
+
+	now := time.Now()
+	if t.StartedAt == nil {
+		t.StartedAt = &now
+	}
+	if state.IsFinal() {
+		t.FinishedAt = &now
+	}
+
+	t.State = state
+	return true
+}
+
+// Progress returns the done part of the task from 0 to 1. Chunks are
+// weighted by their length.
+func (t *ConversionTask) Progress() float64 {
+	if t.State == TaskDoneState {
+		return 1
+	}
+
+	var total, done float64
+	for _, chunk := range t.Chunks {
+		total += chunk.Length
+		done += chunk.Length * chunk.Progress()
+	}
+	if total == 0 {
+		return 0
+	}
+
+	return done / total
+}
+
+// ETA estimates the time left from the time spent so far. It returns
+// false if there is not enough data for the estimation.
+func (t *ConversionTask) ETA() (time.Duration, bool) {
+	if t.StartedAt == nil || t.State.IsFinal() {
+		return 0, false
+	}
+
+	progress := t.Progress()
+	if progress <= 0 {
+		return 0, false
+	}
+
+	elapsed := time.Since(*t.StartedAt)
+	return time.Duration(float64(elapsed) * (1 - progress) / progress), true
+}
+
+// Fail moves the task to the failed state keeping the first error.
+func (t *ConversionTask) Fail(err string) bool {
+	if !t.Advance(TaskFailedState) {
+		return false
+	}
+
+	t.Error = err
+	return true
+}
+
+// Resume brings the failed task back to work once its failed chunks are
+// retried. It is the only way back from a final state and returns false
+// if the task has not failed.
+func (t *ConversionTask) Resume() bool {
+	if t.State != TaskFailedState {
+		return false
+	}
+
+	t.State = TaskConvertingState
+	for _, chunk := range t.Chunks {
+		if chunk.Status < ChunkSplitStatus {
+			t.State = TaskSplittingState
+			break
+		}
+	}
+	t.Error = ""
+	t.FinishedAt = nil
+	return true
+}
+
+// Encoders returns the sorted encoders requested by the task ffmpeg
+// arguments, e.g. libx265 for "c:v": "libx265". Stream copy is not an
+// encoder and is skipped.
+func (t *ConversionTask) Encoders() []string {
+	set := map[string]bool{}
+	for key, value := range t.FFMpegArgs {
+		if !isCodecArg(key) || value == "" || value == "copy" {
+			continue
+		}
+		set[value] = true
+	}
+
+	encoders := []string{}
+	for encoder := range set {
+		encoders = append(encoders, encoder)
+	}
+	sort.Strings(encoders)
+
+	return encoders
+}
+
+func isCodecArg(key string) bool {
+	switch key {
+	case "c", "codec", "vcodec", "acodec", "scodec":
+		return true
+	}
+
+	return strings.HasPrefix(key, "c:") || strings.HasPrefix(key, "codec:")
+}
+
+func (t *ConversionTask) GetChunk(sequence uint32) *Chunk {
+	for _, chunk := range t.Chunks {
+		if chunk.Sequence == sequence {
+			return chunk
+		}
+	}
+
+	return nil
+}
+
+// IsConverted reports whether every chunk of the task has been converted.
+func (t *ConversionTask) IsConverted() bool {
+	if len(t.Chunks) == 0 {
+		return false
+	}
+
+	for _, chunk := range t.Chunks {
+		if chunk.Status != ChunkConvertedStatus && chunk.Status != ChunkJoinedStatus {
+			return false
+		}
+	}
+
+	return true
+}
+
+type ChunkStatus uint8
+
+const (
+	ChunkPendingStatus ChunkStatus = iota
+	ChunkSplittingStatus
+	ChunkSplitStatus
+	ChunkConvertingStatus
+	ChunkConvertedStatus
+	ChunkJoinedStatus
+	ChunkFailedStatus
+)
+
+var chunkStatusNames = map[ChunkStatus]string{
+	ChunkPendingStatus:    "pending",
+	ChunkSplittingStatus:  "splitting",
+	ChunkSplitStatus:      "split",
+	ChunkConvertingStatus: "converting",
+	ChunkConvertedStatus:  "converted",
+	ChunkJoinedStatus:     "joined",
+	ChunkFailedStatus:     "failed",
+}
+
+// ChunkStatuses returns all the chunk statuses.
+func ChunkStatuses() []ChunkStatus {
+	var statuses []ChunkStatus
+	for status := ChunkPendingStatus; status <= ChunkFailedStatus; status++ {
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (s ChunkStatus) String() string {
+	if name, ok := chunkStatusNames[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
 type Chunk struct {
-	Sequence uint32  `json:"sequence"`
-	Offset   float64 `json:"offset"`
-	Length   float64 `json:"length"`
-	File     string  `json:"file"`
-	Status   uint8   `json:"status"`
+	Sequence        uint32      `json:"sequence"`
+	Offset          float64     `json:"offset"`
+	Length          float64     `json:"length"`
+	File            string      `json:"file"`
+	ConvertedFile   string      `json:"converted_file"`
+	Status          ChunkStatus `json:"status"`
+	SplitProgress   float64     `json:"split_progress"`
+	ConvertProgress float64     `json:"convert_progress"`
+	Speed           float64     `json:"speed"`
+	FPS             float64     `json:"fps"`
+	// WorkerID is the worker which has started the split or the
+	// conversion last, only its results are accepted
+	WorkerID string `json:"worker_id"`
+	// Attempts numbers the conversions given out. The workers report the
+	// attempt they run, so the results of the earlier ones are refused.
+	Attempts int `json:"attempts"`
+	// SplitAttempts does the same for the splits
+	SplitAttempts int `json:"split_attempts"`
+	// Losses counts the runs lost by dead workers, the task fails once
+	// the chunk is lost too often
+	Losses int `json:"losses"`
+}
+
+// splitting is a stream copy, so it takes a small part of the whole work
+const splitProgressWeight = 0.1
+
+// Progress returns the done part of the chunk work from 0 to 1.
+func (c *Chunk) Progress() float64 {
+	split, convert := c.SplitProgress, c.ConvertProgress
+	if c.Status >= ChunkSplitStatus && c.Status != ChunkFailedStatus {
+		split = 1
+	}
+	if c.Status >= ChunkConvertedStatus && c.Status != ChunkFailedStatus {
+		convert = 1
+	}
+
+	return split*splitProgressWeight + convert*(1-splitProgressWeight)
+}
+
+// Advance moves the chunk forward to the given status. Worker messages
+// are not ordered, so going backwards or leaving a final status is
+// refused and false is returned.
+func (c *Chunk) Advance(status ChunkStatus) bool {
+	if c.Status == ChunkJoinedStatus || c.Status == ChunkFailedStatus {
+		return false
+	}
+
+	if status <= c.Status {
+		return false
+	}
+
+	c.Status = status
+	return true
+}
+
+// Retry moves the failed chunk back to the given status, so its work is
+// done again. It returns false if the chunk has not failed.
+func (c *Chunk) Retry(status ChunkStatus) bool {
+	if c.Status != ChunkFailedStatus {
+		return false
+	}
+
+	c.Status = status
+	c.WorkerID = ""
+	if status < ChunkSplitStatus {
+		c.SplitProgress = 0
+	}
+	c.ConvertProgress, c.Speed, c.FPS = 0, 0, 0
+	return true
+}
+
+// Requeue gives the work left on the chunk out again as a new attempt.
+// A chunk in progress goes back to the queued status of its stage. It
+// returns false if there is no work left on the chunk.
+func (c *Chunk) Requeue() bool {
+	switch c.Status {
+	case ChunkPendingStatus, ChunkSplittingStatus:
+		c.Status = ChunkPendingStatus
+		c.SplitAttempts++
+		c.SplitProgress = 0
+	case ChunkSplitStatus, ChunkConvertingStatus:
+		c.Status = ChunkSplitStatus
+		c.Attempts++
+	default:
+		return false
+	}
+
+	c.WorkerID = ""
+	c.ConvertProgress, c.Speed, c.FPS = 0, 0, 0
+	return true
 }
 
 type SplitTask struct {
 	ID        string `json:"id"`
 	InputFile string `json:"input_file"`
 	Chunk     *Chunk `json:"chunk"`
+	Attempt   int    `json:"attempt"`
 }
 
 type SplitStartedTask struct {
 	ID        string `json:"id"`
+	Sequence  uint32 `json:"sequence"`
+	Attempt   int    `json:"attempt"`
+	WorkerID  string `json:"worker_id"`
 	ChunkFile string `json:"chunk_file"`
 }
 
 type SplitFinishedTask struct {
 	ID        string `json:"id"`
+	Sequence  uint32 `json:"sequence"`
+	Attempt   int    `json:"attempt"`
+	WorkerID  string `json:"worker_id"`
 	ChunkFile string `json:"chunk_file"`
 }
 
+type SplitErrorTask struct {
+	ID       string `json:"id"`
+	Sequence uint32 `json:"sequence"`
+	Attempt  int    `json:"attempt"`
+	WorkerID string `json:"worker_id"`
+	Error    string `json:"error"`
+}
+
+type ChunkProgressTask struct {
+	ID       string  `json:"id"`
+	Sequence uint32  `json:"sequence"`
+	Attempt  int     `json:"attempt"`
+	WorkerID string  `json:"worker_id"`
+	OutTime  float64 `json:"out_time"`
+	Speed    float64 `json:"speed"`
+	FPS      float64 `json:"fps"`
+}
+
+type ConvertTask struct {
+	ID         string            `json:"id"`
+	Sequence   uint32            `json:"sequence"`
+	Attempt    int               `json:"attempt"`
+	ChunkFile  string            `json:"chunk_file"`
+	OutputExt  string            `json:"output_ext"`
+	FFMpegArgs map[string]string `json:"ffmpeg_args"`
+}
+
+type ConvertStartedTask struct {
+	ID       string `json:"id"`
+	Sequence uint32 `json:"sequence"`
+	Attempt  int    `json:"attempt"`
+	WorkerID string `json:"worker_id"`
+}
+
+type ConvertFinishedTask struct {
+	ID        string `json:"id"`
+	Sequence  uint32 `json:"sequence"`
+	Attempt   int    `json:"attempt"`
+	WorkerID  string `json:"worker_id"`
+	ChunkFile string `json:"chunk_file"`
+}
+
+type ConvertErrorTask struct {
+	ID       string `json:"id"`
+	Sequence uint32 `json:"sequence"`
+	Attempt  int    `json:"attempt"`
+	WorkerID string `json:"worker_id"`
+	Error    string `json:"error"`
+}
+
+// RevokeTask tells the workers to drop the attempt of the chunk stage and
+// the earlier ones, as the chunk has been given out again. Name is the
+// message the attempt was given out with, conversion:split or
+// conversion:convert.
+type RevokeTask struct {
+	ID       string `json:"id"`
+	Sequence uint32 `json:"sequence"`
+	Name     string `json:"name"`
+	Attempt  int    `json:"attempt"`
+}
+
+type JoinTask struct {
+	ID         string   `json:"id"`
+	OutputFile string   `json:"output_file"`
+	ChunkFiles []string `json:"chunk_files"`
+}
+
+type JoinStartedTask struct {
+	ID string `json:"id"`
+}
+
+type JoinFinishedTask struct {
+	ID         string `json:"id"`
+	OutputFile string `json:"output_file"`
+}
+
+type JoinErrorTask struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// CapabilityTopic is a conversion topic consumed only by the workers
+// having all of its encoders.
+type CapabilityTopic struct {
+	Topic    string   `json:"topic"`
+	Encoders []string `json:"encoders"`
+}
+
+type SubscribeTask struct {
+	Topics []*CapabilityTopic `json:"topics"`
+}
+
+type CancelTask struct {
+	ID string `json:"id"`
+}
+
+type DrainTask struct {
+	WorkerID string `json:"worker_id"`
+}
+
+type ThumbnailStatus uint8
+
+const (
+	ThumbnailPendingStatus ThumbnailStatus = iota
+	ThumbnailDoneStatus
+	ThumbnailFailedStatus
+)
+
+var thumbnailStatusNames = map[ThumbnailStatus]string{
+	ThumbnailPendingStatus: "pending",
+	ThumbnailDoneStatus:    "done",
+	ThumbnailFailedStatus:  "failed",
+}
+
+func (s ThumbnailStatus) String() string {
+	if name, ok := thumbnailStatusNames[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
 type ConversionTaskThumbnail struct {
-	Size       uint   `json:"size"`
-	Quality    byte   `json:"quality"`
-	Seek       string `json:"seek"`
-	OutputFile string `json:"ouput_file"`
+	Size       uint            `json:"size"`
+	Quality    byte            `json:"quality"`
+	Seek       string          `json:"seek"`
+	OutputFile string          `json:"output_file"`
+	Status     ThumbnailStatus `json:"status"`
+	Error      string          `json:"error"`
+}
+
+// UnmarshalJSON also accepts the misspelled "ouput_file" key of the
+// earlier API versions.
+func (t *ConversionTaskThumbnail) UnmarshalJSON(data []byte) error {
+	type thumbnail ConversionTaskThumbnail
+	aux := struct {
+		*thumbnail
+		OuputFile string `json:"ouput_file"`
+	}{thumbnail: (*thumbnail)(t)}
+
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	if t.OutputFile == "" {
+		t.OutputFile = aux.OuputFile
+	}
+
+	return nil
+}
+
+type ThumbnailTask struct {
+	ID        string                   `json:"id"`
+	Index     int                      `json:"index"`
+	InputFile string                   `json:"input_file"`
+	Thumbnail *ConversionTaskThumbnail `json:"thumbnail"`
+}
+
+type ThumbnailFinishedTask struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+}
+
+type ThumbnailErrorTask struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Error string `json:"error"`
 }
 
 type ConversionTaskHTTPCallbacks struct {
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+
+	"vconvd/lib"
+)
+
+// DeadLetter is a worker message which has failed all its attempts. The
+// manager keeps it until it is replayed. It has an id of its own, as the
+// transport message ids are not unique across restarts.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	Topic     string    `json:"topic"`
+	Name      string    `json:"name"`
+	TaskID    string    `json:"task_id"`
+	Sequence  uint32    `json:"sequence"`
+	Index     int       `json:"index"`
+	Attempts  uint16    `json:"attempts"`
+	Error     string    `json:"error"`
+	Body      []byte    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewDeadLetter makes a dead letter of the task received from the topic.
+func NewDeadLetter(topic string, task *Task, err error) *DeadLetter {
+	var id string
+	var sequence uint32
+	var index int
+	switch d := task.Data.(type) {
+	case *SplitTask:
+		id, sequence = d.ID, d.Chunk.Sequence
+	case *ConvertTask:
+		id, sequence = d.ID, d.Sequence
+	case *ThumbnailTask:
+		id, index = d.ID, d.Index
+	case *JoinTask:
+		id = d.ID
+	}
+
+	return &DeadLetter{
+		ID:        uuid.New().String(),
+		MessageID: task.Message.ID,
+		Topic:     topic,
+		Name:      task.Name,
+		TaskID:    id,
+		Sequence:  sequence,
+		Index:     index,
+		Attempts:  task.Message.Attempts,
+		Error:     err.Error(),
+		Body:      task.Message.Body,
+		CreatedAt: time.Now(),
+	}
+}
+
+// PublishDeadLetter sends the letter to the dead letter topic to be kept
+// by the manager.
+func PublishDeadLetter(transport lib.Transport, topic, sender string, letter *DeadLetter) error {
+	data, err := EncodeTask(sender, "dead-letter:put", letter)
+	if err != nil {
+		return err
+	}
+
+	return transport.Publish(topic, data)
+}
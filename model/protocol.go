@@ -0,0 +1,207 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack"
+)
+
+// ProtocolVersion is the version of the Task envelope and its payloads.
+// It has to be bumped on any incompatible change of them.
+const ProtocolVersion = 2
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// payloadTypes maps the message names to their payload types.
+var payloadTypes = map[string]func() interface{}{
+	"conversion:put":       func() interface{} { return &ConversionTask{} },
+	"conversion:split":     func() interface{} { return &SplitTask{} },
+	"conversion:thumbnail": func() interface{} { return &ThumbnailTask{} },
+	"conversion:convert":   func() interface{} { return &ConvertTask{} },
+	"conversion:join":      func() interface{} { return &JoinTask{} },
+	"conversion:cancel":    func() interface{} { return &CancelTask{} },
+	"conversion:revoke":    func() interface{} { return &RevokeTask{} },
+
+	"splitter-worker:register":         func() interface{} { return &Worker{} },
+	"splitter-worker:ping":             func() interface{} { return &Worker{} },
+	"splitter-worker:registered":       func() interface{} { return &Worker{} },
+	"splitter-worker:drain":            func() interface{} { return &DrainTask{} },
+	"splitter-worker:start":            func() interface{} { return &SplitStartedTask{} },
+	"splitter-worker:finish":           func() interface{} { return &SplitFinishedTask{} },
+	"splitter-worker:error":            func() interface{} { return &SplitErrorTask{} },
+	"splitter-worker:progress":         func() interface{} { return &ChunkProgressTask{} },
+	"splitter-worker:thumbnail-finish": func() interface{} { return &ThumbnailFinishedTask{} },
+	"splitter-worker:thumbnail-error":  func() interface{} { return &ThumbnailErrorTask{} },
+
+	"conversion-worker:register":   func() interface{} { return &Worker{} },
+	"conversion-worker:ping":       func() interface{} { return &Worker{} },
+	"conversion-worker:registered": func() interface{} { return &Worker{} },
+	"conversion-worker:subscribe":  func() interface{} { return &SubscribeTask{} },
+	"conversion-worker:drain":      func() interface{} { return &DrainTask{} },
+	"conversion-worker:start":      func() interface{} { return &ConvertStartedTask{} },
+	"conversion-worker:finish":     func() interface{} { return &ConvertFinishedTask{} },
+	"conversion-worker:error":      func() interface{} { return &ConvertErrorTask{} },
+	"conversion-worker:progress":   func() interface{} { return &ChunkProgressTask{} },
+
+	"joiner-worker:start":  func() interface{} { return &JoinStartedTask{} },
+	"joiner-worker:finish": func() interface{} { return &JoinFinishedTask{} },
+	"joiner-worker:error":  func() interface{} { return &JoinErrorTask{} },
+
+	"dead-letter:put": func() interface{} { return &DeadLetter{} },
+}
+
+// EncodeTask wraps the payload into an envelope of the current protocol
+// version. The payload has to be of the type registered for the name.
+func EncodeTask(sender string, name string, data interface{}) ([]byte, error) {
+	newPayload, ok := payloadTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown message %q", name)
+	}
+
+	value := reflect.ValueOf(data)
+	if data == nil || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		return nil, fmt.Errorf("%s payload is nil", name)
+	}
+
+	expected := reflect.TypeOf(newPayload()).Elem()
+	if t := reflect.Indirect(value).Type(); t != expected {
+		return nil, fmt.Errorf("%s payload must be %s, got %s", name, expected, t)
+	}
+
+	payload, err := msgpack.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal the %s payload: %s", name, err)
+	}
+
+	return msgpack.Marshal(Task{
+		Version:   ProtocolVersion,
+		ID:        uuid.New().String(),
+		Timestamp: time.Now(),
+		Sender:    sender,
+		Name:      name,
+		Payload:   payload,
+	})
+}
+
+// DecodeTask unwraps the envelope and decodes its payload into the type
+// registered for the message name. Messages of other protocol versions,
+// unknown messages and the payloads missing the required fields are
+// rejected with an error.
+func DecodeTask(body []byte) (*Task, error) {
+	var task Task
+	err := msgpack.Unmarshal(body, &task)
+	if err != nil {
+		return nil, fmt.Errorf("malformed message: %s", err)
+	}
+
+	if task.Version != ProtocolVersion {
+		return nil, fmt.Errorf("%w %d of the %q message from %q", ErrUnsupportedVersion, task.Version, task.Name, task.Sender)
+	}
+
+	newPayload, ok := payloadTypes[task.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown message %q from %q", task.Name, task.Sender)
+	}
+
+	data := newPayload()
+	err = msgpack.Unmarshal(task.Payload, data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s payload from %q: %s", task.Name, task.Sender, err)
+	}
+
+	err = validatePayload(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s payload from %q: %s", task.Name, task.Sender, err)
+	}
+
+	task.Data = data
+	return &task, nil
+}
+
+func validatePayload(data interface{}) error {
+	var missing string
+	switch d := data.(type) {
+	case *ConversionTask:
+		missing = firstEmpty("input_file", d.InputFile, "output_file", d.OutputFile)
+	case *SplitTask:
+		missing = firstEmpty("id", d.ID, "input_file", d.InputFile)
+		if missing == "" && d.Chunk == nil {
+			missing = "chunk"
+		}
+	case *ThumbnailTask:
+		missing = firstEmpty("id", d.ID, "input_file", d.InputFile)
+		if missing == "" && d.Thumbnail == nil {
+			missing = "thumbnail"
+		}
+	case *ConvertTask:
+		missing = firstEmpty("id", d.ID, "chunk_file", d.ChunkFile)
+	case *JoinTask:
+		missing = firstEmpty("id", d.ID, "output_file", d.OutputFile)
+		if missing == "" && len(d.ChunkFiles) == 0 {
+			missing = "chunk_files"
+		}
+	case *CancelTask:
+		missing = firstEmpty("id", d.ID)
+	case *RevokeTask:
+		missing = firstEmpty("id", d.ID, "name", d.Name)
+	case *SplitStartedTask:
+		missing = firstEmpty("id", d.ID, "worker_id", d.WorkerID)
+	case *SplitFinishedTask:
+		missing = firstEmpty("id", d.ID, "worker_id", d.WorkerID, "chunk_file", d.ChunkFile)
+	case *SplitErrorTask:
+		missing = firstEmpty("id", d.ID)
+	case *ChunkProgressTask:
+		missing = firstEmpty("id", d.ID, "worker_id", d.WorkerID)
+	case *ThumbnailFinishedTask:
+		missing = firstEmpty("id", d.ID)
+	case *ThumbnailErrorTask:
+		missing = firstEmpty("id", d.ID)
+	case *Worker:
+		missing = firstEmpty("id", d.ID)
+	case *SubscribeTask:
+		for _, topic := range d.Topics {
+			if topic == nil || topic.Topic == "" {
+				missing = "topic"
+			}
+		}
+	case *DrainTask:
+		missing = firstEmpty("worker_id", d.WorkerID)
+	case *ConvertStartedTask:
+		missing = firstEmpty("id", d.ID, "worker_id", d.WorkerID)
+	case *ConvertFinishedTask:
+		missing = firstEmpty("id", d.ID, "worker_id", d.WorkerID, "chunk_file", d.ChunkFile)
+	case *ConvertErrorTask:
+		missing = firstEmpty("id", d.ID)
+	case *JoinStartedTask:
+		missing = firstEmpty("id", d.ID)
+	case *JoinFinishedTask:
+		missing = firstEmpty("id", d.ID)
+	case *JoinErrorTask:
+		missing = firstEmpty("id", d.ID)
+	case *DeadLetter:
+		missing = firstEmpty("id", d.ID, "topic", d.Topic)
+		if missing == "" && len(d.Body) == 0 {
+			missing = "body"
+		}
+	}
+
+	if missing != "" {
+		return fmt.Errorf("%s is required", missing)
+	}
+	return nil
+}
+
+// firstEmpty takes name and value pairs and returns the name of the first
+// empty value.
+func firstEmpty(pairs ...string) string {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			return pairs[i]
+		}
+	}
+	return ""
+}
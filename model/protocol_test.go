@@ -0,0 +1,136 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func envelope(t *testing.T, version uint16, name string, data interface{}) []byte {
+	t.Helper()
+
+	payload, err := msgpack.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := msgpack.Marshal(Task{Version: version, Sender: "test", Name: name, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestDecodeTask(t *testing.T) {
+	cancel := &CancelTask{ID: "task"}
+
+	tests := []struct {
+		name    string
+		body    []byte
+		wantErr string
+		version bool
+	}{
+		{
+			name: "current version",
+			body: envelope(t, ProtocolVersion, "conversion:cancel", cancel),
+		},
+		{
+			name:    "older version",
+			body:    envelope(t, ProtocolVersion-1, "conversion:cancel", cancel),
+			wantErr: "unsupported protocol version",
+			version: true,
+		},
+		{
+			name:    "newer version",
+			body:    envelope(t, ProtocolVersion+1, "conversion:cancel", cancel),
+			wantErr: "unsupported protocol version",
+			version: true,
+		},
+		{
+			name:    "message before the envelope",
+			body:    envelope(t, 0, "", cancel),
+			wantErr: "unsupported protocol version",
+			version: true,
+		},
+		{
+			name:    "unknown message",
+			body:    envelope(t, ProtocolVersion, "conversion:pause", cancel),
+			wantErr: `unknown message "conversion:pause"`,
+		},
+		{
+			name:    "missing field",
+			body:    envelope(t, ProtocolVersion, "conversion:cancel", &CancelTask{}),
+			wantErr: "invalid conversion:cancel payload",
+		},
+		{
+			name:    "malformed envelope",
+			body:    []byte("conversion:cancel"),
+			wantErr: "malformed message",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task, err := DecodeTask(tt.body)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if data, ok := task.Data.(*CancelTask); !ok || data.ID != cancel.ID {
+					t.Errorf("got %#v, want %#v", task.Data, cancel)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrUnsupportedVersion) != tt.version {
+				t.Errorf("errors.Is(%v, ErrUnsupportedVersion) = %t", err, !tt.version)
+			}
+		})
+	}
+}
+
+func TestEncodeTask(t *testing.T) {
+	var nilCancel *CancelTask
+
+	tests := []struct {
+		name    string
+		message string
+		data    interface{}
+		wantErr string
+	}{
+		{name: "pointer", message: "conversion:cancel", data: &CancelTask{ID: "task"}},
+		{name: "value", message: "conversion:cancel", data: CancelTask{ID: "task"}},
+		{name: "nil", message: "conversion:cancel", data: nil, wantErr: "payload is nil"},
+		{name: "typed nil", message: "conversion:cancel", data: nilCancel, wantErr: "payload is nil"},
+		{name: "wrong type", message: "conversion:cancel", data: &DrainTask{}, wantErr: "payload must be"},
+		{name: "unknown message", message: "conversion:pause", data: &CancelTask{ID: "task"}, wantErr: "unknown message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := EncodeTask("test", tt.message, tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			task, err := DecodeTask(body)
+			if err != nil {
+				t.Fatalf("can not decode: %s", err)
+			}
+			if task.Name != tt.message || task.Sender != "test" {
+				t.Errorf("got %s from %s", task.Name, task.Sender)
+			}
+		})
+	}
+}
@@ -3,150 +3,503 @@ package splitterworker
 import (
 	"fmt"
 	"path/filepath"
+	"sync"
+	"time"
 	"vconvd/lib"
 	"vconvd/logger"
 	"vconvd/model"
 
-	"github.com/mitchellh/mapstructure"
-	nsq "github.com/nsqio/go-nsq"
+	"github.com/google/uuid"
 	ffmpeg_go "github.com/u2takey/ffmpeg-go"
-	"github.com/vmihailenco/msgpack"
 )
 
 var log = logger.Log
 
+// Chunks start on keyframes. ffmpeg truncates -ss to microseconds, which may
+// move the seek before the keyframe and copy the whole previous GOP, so the
+// seek is moved a bit forward. The duration is shortened by the same value
+// to stop right before the keyframe of the next chunk.
+const seekEpsilon = 0.001
+
 type Config struct {
-	NsqdHost         string
-	NsqdPort         int
-	NsqdManagerTopic string
-	NsqdTopic        string
-	ChunkPath        string
+	NsqdHost             string
+	NsqdPort             int
+	NsqdAddresses        []string
+	LookupdHTTPAddresses []string
+	NsqdManagerTopic     string
+	NsqdTopic            string
+	NsqdControlTopic     string
+	NsqdDeadLetterTopic  string
+	ChunkPath            string
+	MetricsAddress       string
+	HeartbeatInterval    time.Duration
+	MaxAttempts          uint16
+	RetryDelay           time.Duration
+	RetryMaxDelay        time.Duration
+	MsgTimeout           time.Duration
+	Concurrency          int
 }
 
 type SplitterWorker struct {
-	Config   *Config
-	consumer *lib.NsqConsumer
-	producer *lib.NsqProducer
-	done     chan bool
+	Config    *Config
+	Transport lib.Transport
+
+	id          string
+	consumer    lib.Subscription
+	runner      lib.FFMpegRunner
+	revocations lib.Revocations
+	retry       *lib.RetryPolicy
+	inflight    *lib.InFlight
+	// workerLock guards worker, it is updated by KeepAlive and drain
+	workerLock sync.Mutex
+	worker     *model.Worker
+	keepAlive  sync.Once
+	done       lib.Done
 }
 
 type messageHandler struct{}
 
 func (w *SplitterWorker) Start() {
-	w.done = make(chan bool)
+	w.id = uuid.New().String()
+	w.retry = &lib.RetryPolicy{
+		MaxAttempts: w.Config.MaxAttempts,
+		Delay:       w.Config.RetryDelay,
+		MaxDelay:    w.Config.RetryMaxDelay,
+	}
+
+	w.worker = &model.Worker{ID: w.id}
+	w.updateSystemInfo()
+	worker := w.workerInfo()
 
-	w.consumer = &lib.NsqConsumer{
-		Host:  w.Config.NsqdHost,
-		Port:  w.Config.NsqdPort,
-		Topic: w.Config.NsqdTopic,
-		Log:   true,
+	if w.Transport == nil {
+		transport := &lib.NsqTransport{
+			Host:                 w.Config.NsqdHost,
+			Port:                 w.Config.NsqdPort,
+			Addresses:            w.Config.NsqdAddresses,
+			LookupdHTTPAddresses: w.Config.LookupdHTTPAddresses,
+			Log:                  true,
+		}
+		err := transport.Connect()
+		if err != nil {
+			log.Fatalf("Can not connect producer to nsqd at %s %s", transport, err)
+		} else {
+			log.Debugf("Producer succesfully connected to nsqd: %s", transport)
+		}
+		defer transport.Stop()
+
+		w.Transport = transport
 	}
 
-	err := w.consumer.Setup()
-	if err != nil {
-		log.Fatalf("Can not setup nsqd consumer: %s", err)
+	config := &lib.SubscribeConfig{
+		Topic:       w.Config.NsqdTopic,
+		MaxAttempts: w.Config.MaxAttempts,
+		MsgTimeout:  w.Config.MsgTimeout,
+		MaxInFlight: w.concurrency(),
+		Concurrency: w.concurrency(),
 	}
+	w.inflight = &lib.InFlight{TouchInterval: config.TouchInterval()}
 
-	w.consumer.Nsqc.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
+	var err error
+	w.consumer, err = w.Transport.Subscribe(config, func(message *lib.Message) error {
 		w.handleMessage(message)
 		return nil
-	}))
+	})
+	if err != nil {
+		log.Fatalf("Can not subscribe to the splitter topic: %s", err)
+	}
 
-	err = w.consumer.Connect()
+	_, err = w.Transport.Subscribe(&lib.SubscribeConfig{
+		Topic:   w.Config.NsqdControlTopic,
+		Channel: lib.BroadcastChannel(),
+		Direct:  true,
+	}, func(message *lib.Message) error {
+		w.handleControlMessage(message)
+		return nil
+	})
 	if err != nil {
-		log.Fatalf("Can not connect consumer to nsqd at %s:%d %s", w.Config.NsqdHost, w.Config.NsqdPort, err)
-	} else {
-		log.Debugf("Succesfully connected to nsqd: %s:%d", w.Config.NsqdHost, w.Config.NsqdPort)
+		log.Fatalf("Can not subscribe to the control topic: %s", err)
 	}
 
-	w.producer = &lib.NsqProducer{
-		Host: w.Config.NsqdHost,
-		Port: w.Config.NsqdPort,
-		Log:  true,
+	// the manager replies and sends the worker commands to its own topic
+	_, err = w.Transport.Subscribe(&lib.SubscribeConfig{
+		Topic:   model.WorkerTopic(w.id),
+		Channel: "control#ephemeral",
+		// the topic is new, the registration reply must not wait for
+		// the next nsqlookupd poll
+		Direct: true,
+	}, func(message *lib.Message) error {
+		w.handleControlMessage(message)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Can not subscribe to the worker topic: %s", err)
 	}
-	err = w.producer.Setup()
+
+	log.Infof("Worker %s: %d CPUs, %d slots, ffmpeg %s", worker.ID, worker.CPUCount, worker.Slots, worker.FFMpegVersion)
+
+	err = w.publish("splitter-worker:register", &worker)
 	if err != nil {
-		log.Fatalf("Can not connect producer to nsqd at %s:%d %s", w.Config.NsqdHost, w.Config.NsqdPort, err)
-	} else {
-		log.Debugf("Producer succesfully connected to nsqd: %s:%d", w.Config.NsqdHost, w.Config.NsqdPort)
+		log.Errorf("Failed to publish the registration: %s", err)
+	}
+
+	if w.Config.MetricsAddress != "" {
+		go func() {
+			err := lib.ServeMetrics(w.Config.MetricsAddress)
+			log.Errorf("Can not serve the metrics at %s: %s", w.Config.MetricsAddress, err)
+		}()
 	}
 
-	<-w.done
+	<-w.done.C()
+}
+
+func (w *SplitterWorker) KeepAlive() {
+	w.keepAlive.Do(func() {
+		go func() {
+			for true {
+				w.updateSystemInfo()
+				worker := w.workerInfo()
+				err := w.publish("splitter-worker:ping", &worker)
+				if err != nil {
+					log.Errorf("Failed to publish a heartbeat: %s", err)
+				}
+
+				select {
+				case <-w.done.C():
+					return
+				case <-time.After(w.Config.HeartbeatInterval):
+				}
+			}
+		}()
+	})
+}
+
+// workerInfo returns a copy of the worker reported to the manager.
+func (w *SplitterWorker) workerInfo() model.Worker {
+	w.workerLock.Lock()
+	defer w.workerLock.Unlock()
+
+	return *w.worker
+}
+
+// updateSystemInfo refreshes the resources reported to the manager.
+func (w *SplitterWorker) updateSystemInfo() {
+	info := lib.GetSystemInfo(w.Config.ChunkPath)
+
+	w.workerLock.Lock()
+	defer w.workerLock.Unlock()
+
+	w.worker.Hostname = info.Hostname
+	w.worker.CPUCount = info.CPUCount
+	w.worker.FreeMemory = info.FreeMemory
+	w.worker.FreeDisk = info.FreeDisk
+	w.worker.FFMpegVersion = info.FFMpegVersion
+	w.worker.Slots = w.concurrency()
+}
+
+func (w *SplitterWorker) concurrency() int {
+	if w.Config.Concurrency < 1 {
+		return 1
+	}
+	return w.Config.Concurrency
 }
 
 func (w *SplitterWorker) Stop() {
-	w.done <- true
+	w.done.Close()
 }
 
-func (w *SplitterWorker) handleMessage(m *nsq.Message) error {
-	var task model.Task
-	err := msgpack.Unmarshal(m.Body, &task)
+func (w *SplitterWorker) handleMessage(m *lib.Message) error {
+	task, err := model.DecodeTask(m.Body)
 	if err != nil {
 		log.Errorf("Can not unmarshal a message: %s", err)
+		lib.CountMessageError("splitter", "")
+		m.Finish()
 		return err
 	}
+	task.Message = m
 
 	log.Debugf("Got a message: %v", task)
 
+	if !w.inflight.Begin(m) {
+		log.Debugf("Ignoring a redelivery of the message %s", m.ID)
+		return nil
+	}
+
 	err = nil
 	switch task.Name {
 	case "conversion:split":
-		err = w.split(&task)
+		err = w.split(task)
+	case "conversion:thumbnail":
+		err = w.thumbnail(task)
+	}
+
+	if err != nil {
+		lib.CountMessageError("splitter", task.Name)
+	}
+	w.retry.Settle(w.inflight, m, err, func(latest *lib.Message) {
+		task.Message = latest
+		w.giveUp(task, err)
+	})
+
+	return nil
+}
+
+// giveUp reports the split or thumbnail out of attempts to the manager and
+// dead letters it.
+func (w *SplitterWorker) giveUp(task *model.Task, err error) {
+	letter := model.NewDeadLetter(w.Config.NsqdTopic, task, err)
+
+	var perr error
+	switch task.Name {
+	case "conversion:split":
+		perr = w.publish("splitter-worker:error", model.SplitErrorTask{
+			ID:       letter.TaskID,
+			Sequence: letter.Sequence,
+			Attempt:  task.Data.(*model.SplitTask).Attempt,
+			WorkerID: w.id,
+			Error:    err.Error(),
+		})
+	case "conversion:thumbnail":
+		perr = w.publish("splitter-worker:thumbnail-error", model.ThumbnailErrorTask{
+			ID:    letter.TaskID,
+			Index: letter.Index,
+			Error: err.Error(),
+		})
+	}
+	if perr != nil {
+		log.Errorf("Failed to publish the error of the task %s: %s", letter.TaskID, perr)
 	}
 
+	perr = model.PublishDeadLetter(w.Transport, w.Config.NsqdDeadLetterTopic, w.id, letter)
+	if perr != nil {
+		log.Errorf("Failed to publish a dead letter of the task %s: %s", letter.TaskID, perr)
+	}
+}
+
+func (w *SplitterWorker) handleControlMessage(m *lib.Message) error {
+	task, err := model.DecodeTask(m.Body)
 	if err != nil {
-		log.Errorf("%s", err)
+		log.Errorf("Can not unmarshal a control message: %s", err)
+		lib.CountMessageError("splitter", "")
+		m.Finish()
+		return err
+	}
+
+	switch task.Name {
+	case "conversion:cancel":
+		w.cancel(task)
+	case "conversion:revoke":
+		w.revoke(task)
+	case "splitter-worker:registered":
+		log.Infof("Registered succesfully")
+		w.KeepAlive()
+	case "splitter-worker:drain":
+		w.drain()
 	}
 
 	return nil
 }
 
+// drain stops taking new chunks. The chunks in progress are finished and
+// the worker keeps reporting to the manager until it is stopped.
+func (w *SplitterWorker) drain() {
+	log.Infof("Draining, no new chunks will be taken")
+
+	w.workerLock.Lock()
+	w.worker.Draining = true
+	w.workerLock.Unlock()
+
+	w.consumer.ChangeMaxInFlight(0)
+}
+
+// revoke stops the split attempts the manager has given out again.
+func (w *SplitterWorker) revoke(task *model.Task) {
+	revokeTask := task.Data.(*model.RevokeTask)
+	if revokeTask.Name != "conversion:split" {
+		return
+	}
+
+	log.Debugf("Revoking the split attempt %d of the chunk %d of the task %s",
+		revokeTask.Attempt, revokeTask.Sequence, revokeTask.ID)
+	w.revocations.Revoke(revokeTask.ID, revokeTask.Sequence, revokeTask.Attempt)
+}
+
+func (w *SplitterWorker) cancel(task *model.Task) {
+	cancelTask := task.Data.(*model.CancelTask)
+
+	log.Infof("Cancelling the task %s", cancelTask.ID)
+
+	w.runner.Cancel(cancelTask.ID)
+	err := lib.RemoveChunkFiles(w.Config.ChunkPath, cancelTask.ID)
+	if err != nil {
+		log.Errorf("Can not remove chunk files of the task %s: %s", cancelTask.ID, err)
+	}
+}
+
 func (w *SplitterWorker) split(task *model.Task) error {
-	var splitTask model.SplitTask
-	mapstructure.Decode(task.Data, &splitTask)
+	splitTask := task.Data.(*model.SplitTask)
 
-	path := filepath.FromSlash(fmt.Sprintf("%s/%s_%d%s",
+	if w.runner.IsCancelled(splitTask.ID) {
+		log.Debugf("Dropping the chunk %d of the cancelled task %s", splitTask.Chunk.Sequence, splitTask.ID)
+		return nil
+	}
+
+	// every run has a file of its own, so a duplicate of the run never
+	// writes a file which is being converted
+	path := filepath.FromSlash(fmt.Sprintf("%s/%s_%d_%d_%s%s",
 		w.Config.ChunkPath,
 		splitTask.ID,
 		splitTask.Chunk.Sequence,
+		splitTask.Attempt,
+		w.id,
 		filepath.Ext(splitTask.InputFile),
 	))
 
-	st := model.Task{Name: "splitter-worker:start", Data: model.SplitStartedTask{ID: splitTask.ID, ChunkFile: path}}
-	data, err := msgpack.Marshal(st)
+	stream := ffmpeg_go.
+		Input(splitTask.InputFile, ffmpeg_go.KwArgs{
+			"ss": splitTask.Chunk.Offset + seekEpsilon,
+		}).
+		Output(path, ffmpeg_go.KwArgs{
+			"t":                 splitTask.Chunk.Length - seekEpsilon,
+			"vcodec":            "copy",
+			"acodec":            "copy",
+			"avoid_negative_ts": "make_zero",
+		}).
+		OverWriteOutput().
+		ErrorToStdOut()
+
+	ctx, ok := w.revocations.Begin(stream.Context, splitTask.ID, splitTask.Chunk.Sequence, splitTask.Attempt)
+	if !ok {
+		log.Debugf("Dropping the revoked split attempt %d of the chunk %d of the task %s",
+			splitTask.Attempt, splitTask.Chunk.Sequence, splitTask.ID)
+		return nil
+	}
+	defer w.revocations.End(splitTask.ID, splitTask.Chunk.Sequence, splitTask.Attempt)
+	stream.Context = ctx
+
+	data, err := model.EncodeTask(w.id, "splitter-worker:start", model.SplitStartedTask{
+		ID:        splitTask.ID,
+		Sequence:  splitTask.Chunk.Sequence,
+		Attempt:   splitTask.Attempt,
+		WorkerID:  w.id,
+		ChunkFile: path,
+	})
 	if err != nil {
 		return fmt.Errorf("Failed to marshal a SplitStartedTask to the msgpack format: %s", err)
 	}
-	err = w.producer.Nsqp.Publish(w.Config.NsqdManagerTopic, data)
+	err = w.Transport.Publish(w.Config.NsqdManagerTopic, data)
 	if err != nil {
 		return fmt.Errorf("Failed to pubslish a SplitStartedTask to the queue: %s", err)
 	}
 
-	err = ffmpeg_go.
-		Input(splitTask.InputFile, ffmpeg_go.KwArgs{
-			"ss": splitTask.Chunk.Offset,
-			"t":  splitTask.Chunk.Length,
-		}).
-		Output(path, ffmpeg_go.KwArgs{
-			"vcodec": "copy",
-			"acodec": "copy",
-		}).
-		ErrorToStdOut().
-		Run()
+	started := time.Now()
+	var speed float64
+	err = w.runner.RunWithProgress(splitTask.ID, stream, func(progress lib.FFMpegProgress) {
+		speed = progress.Speed
+		perr := w.publish("splitter-worker:progress", model.ChunkProgressTask{
+			ID:       splitTask.ID,
+			Sequence: splitTask.Chunk.Sequence,
+			Attempt:  splitTask.Attempt,
+			WorkerID: w.id,
+			OutTime:  progress.OutTime.Seconds(),
+			Speed:    progress.Speed,
+			FPS:      progress.FPS,
+		})
+		if perr != nil {
+			log.Errorf("Failed to publish a ChunkProgressTask: %s", perr)
+		}
+	})
 
+	if err == lib.ErrCancelled {
+		log.Infof("Splitting of the chunk %d of the task %s is cancelled", splitTask.Chunk.Sequence, splitTask.ID)
+		return nil
+	}
+	if w.revocations.IsRevoked(splitTask.ID, splitTask.Chunk.Sequence, splitTask.Attempt) {
+		log.Infof("Splitting of the chunk %d of the task %s is revoked", splitTask.Chunk.Sequence, splitTask.ID)
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("Splitting error: %s", err)
 	}
+	lib.ObserveStage("split", started, speed)
 
-	ft := model.Task{Name: "splitter-worker:finish", Data: model.SplitFinishedTask{ID: splitTask.ID}}
-	data, err = msgpack.Marshal(ft)
+	data, err = model.EncodeTask(w.id, "splitter-worker:finish", model.SplitFinishedTask{
+		ID:        splitTask.ID,
+		Sequence:  splitTask.Chunk.Sequence,
+		Attempt:   splitTask.Attempt,
+		WorkerID:  w.id,
+		ChunkFile: path,
+	})
 	if err != nil {
 		return fmt.Errorf("Failed to marshal a SplitFinishTask to the msgpack format: %s", err)
 	}
-	err = w.producer.Nsqp.Publish(w.Config.NsqdManagerTopic, data)
+	err = w.Transport.Publish(w.Config.NsqdManagerTopic, data)
 	if err != nil {
 		return fmt.Errorf("Failed to pubslish a SplitStartedTask to the queue: %s", err)
 	}
 
 	return err
 }
+
+func (w *SplitterWorker) thumbnail(task *model.Task) error {
+	thumbnailTask := task.Data.(*model.ThumbnailTask)
+
+	if w.runner.IsCancelled(thumbnailTask.ID) {
+		log.Debugf("Dropping the thumbnail %d of the cancelled task %s", thumbnailTask.Index, thumbnailTask.ID)
+		return nil
+	}
+
+	thumbnail := thumbnailTask.Thumbnail
+	args := ffmpeg_go.KwArgs{"frames:v": 1}
+	if thumbnail.Size > 0 {
+		args["vf"] = fmt.Sprintf("scale=%d:-2", thumbnail.Size)
+	}
+	if thumbnail.Quality > 0 {
+		args["q:v"] = jpegQScale(thumbnail.Quality)
+	}
+
+	inputArgs := ffmpeg_go.KwArgs{}
+	if thumbnail.Seek != "" {
+		inputArgs["ss"] = thumbnail.Seek
+	}
+
+	err := w.runner.Run(thumbnailTask.ID, ffmpeg_go.
+		Input(thumbnailTask.InputFile, inputArgs).
+		Output(thumbnail.OutputFile, args).
+		OverWriteOutput().
+		ErrorToStdOut())
+
+	if err == lib.ErrCancelled {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Thumbnail error: %s", err)
+	}
+
+	err = w.publish("splitter-worker:thumbnail-finish", model.ThumbnailFinishedTask{
+		ID:    thumbnailTask.ID,
+		Index: thumbnailTask.Index,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to publish a ThumbnailFinishedTask: %s", err)
+	}
+
+	return nil
+}
+
+// jpegQScale maps the 1-100 JPEG quality to the ffmpeg 31-2 qscale.
+func jpegQScale(quality byte) int {
+	if quality > 100 {
+		quality = 100
+	}
+
+	return 31 - (int(quality)-1)*29/99
+}
+
+func (w *SplitterWorker) publish(name string, data interface{}) error {
+	buf, err := model.EncodeTask(w.id, name, data)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal a task data to the msgpack format: %s", err)
+	}
+
+	return w.Transport.Publish(w.Config.NsqdManagerTopic, buf)
+}